@@ -7,6 +7,8 @@ import (
 type Address struct {
 	function *SexpFunction
 	position int
+	// nargs is the number of arguments passed to the called function
+	nargs int
 }
 
 type AddrStack struct {
@@ -73,6 +75,11 @@ func (stack *AddrStack) PushAddr(function *SexpFunction, pc int) {
 	stack.Push(Address{function: function, position: pc})
 }
 
+// PushCall pushes the return address of a call passing nargs arguments.
+func (stack *AddrStack) PushCall(function *SexpFunction, pc int, nargs int) {
+	stack.Push(Address{function: function, position: pc, nargs: nargs})
+}
+
 func (stack *AddrStack) PopAddr() (fn *SexpFunction, pos int, err error) {
 	addr, err := stack.Pop()
 	if err != nil {
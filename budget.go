@@ -0,0 +1,72 @@
+package glisp
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// BudgetExceededError is returned by Run once the instruction budget set by
+// SetInstructionBudget is used up.
+type BudgetExceededError struct {
+	Limit int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("instruction budget of %d exceeded", e.Limit)
+}
+
+// instrBudget is shared by an environment and every environment duplicated
+// from it, so coroutines started by `go` draw from the same budget.
+type instrBudget struct {
+	limit int64
+	used  int64
+}
+
+// consume adds n executed instructions, it returns the number of
+// instructions left or a BudgetExceededError. A zero limit means no limit.
+func (b *instrBudget) consume(n int64) (int64, error) {
+	used := atomic.AddInt64(&b.used, n)
+	limit := atomic.LoadInt64(&b.limit)
+	if limit <= 0 {
+		return CheckpointInterval, nil
+	}
+	if used > limit {
+		return 0, &BudgetExceededError{Limit: limit}
+	}
+	return limit - used, nil
+}
+
+// currentLimit returns the limit, coroutines sharing the budget may reset
+// it concurrently.
+func (b *instrBudget) currentLimit() int64 {
+	return atomic.LoadInt64(&b.limit)
+}
+
+func (b *instrBudget) reset(limit int64) {
+	atomic.StoreInt64(&b.limit, limit)
+	atomic.StoreInt64(&b.used, 0)
+}
+
+// SetInstructionBudget limits the number of instructions that Run may
+// execute from now on, n <= 0 removes the limit. The counter is shared with
+// environments created by Duplicate. The check is exact for a single
+// environment, concurrent coroutines may overrun it by a few hundred
+// instructions each.
+func (env *Environment) SetInstructionBudget(n int64) {
+	env.flushTicks()
+	env.budget.reset(n)
+	env.nextCheckpoint = env.ticks
+}
+
+// InstructionsUsed returns the number of instructions executed since the
+// last call of SetInstructionBudget.
+func (env *Environment) InstructionsUsed() int64 {
+	env.flushTicks()
+	return atomic.LoadInt64(&env.budget.used)
+}
+
+func (env *Environment) flushTicks() (int64, error) {
+	n := env.ticks - env.flushedTicks
+	env.flushedTicks = env.ticks
+	return env.budget.consume(n)
+}
@@ -0,0 +1,595 @@
+package glisp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// BytecodeVersion is the version of the format written by CompileToWriter,
+// it changes whenever the instructions or their encoding change.
+const BytecodeVersion = 7
+
+var bytecodeMagic = []byte("GLISPBC\x00")
+
+// ErrBytecodeVersion is returned by LoadCompiled for bytecode written in
+// another format version, such bytecode must be compiled again.
+var ErrBytecodeVersion = errors.New("unsupported bytecode version")
+
+// IsBytecode reports whether data starts like bytecode written by
+// CompileToWriter.
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, bytecodeMagic)
+}
+
+// CompileToWriter compiles expressions and writes the bytecode to w, it can
+// be loaded later by LoadCompiled without parsing the script again. Macros
+// are expanded at compile time, macros defined by the script itself are
+// not part of the bytecode.
+func (env *Environment) CompileToWriter(w io.Writer, expressions []Sexp) error {
+	gen := NewGenerator(env)
+	if err := gen.GenerateBegin(expressions); err != nil {
+		return err
+	}
+	bw := &bytecodeWriter{
+		w:    bufio.NewWriter(w),
+		strs: make(map[string]int),
+		poss: make(map[*Position]int),
+	}
+	bw.w.Write(bytecodeMagic)
+	bw.uvarint(BytecodeVersion)
+	bw.function(MakeFunction("__main", 0, false, gen.code()))
+	if bw.err != nil {
+		return bw.err
+	}
+	return bw.w.Flush()
+}
+
+// LoadCompiled loads bytecode written by CompileToWriter like LoadStream
+// loads a script, Run executes it. Symbols are mapped to the symbol table
+// of env.
+func (env *Environment) LoadCompiled(r io.Reader) error {
+	br := &bytecodeReader{env: env, r: bufio.NewReader(r)}
+	magic := make([]byte, len(bytecodeMagic))
+	if _, err := io.ReadFull(br.r, magic); err != nil || !bytes.Equal(magic, bytecodeMagic) {
+		return errors.New("not glisp bytecode")
+	}
+	if version := br.uvarint(); br.err == nil && version != BytecodeVersion {
+		return fmt.Errorf("%w %d, expected %d", ErrBytecodeVersion, version, BytecodeVersion)
+	}
+	main := br.function()
+	if br.err != nil {
+		return fmt.Errorf("bad bytecode: %w", br.err)
+	}
+	env.mainfunc.fun = append(env.mainfunc.fun, main.fun...)
+	env.curfunc = env.mainfunc
+	return nil
+}
+
+const (
+	tagSentinel byte = iota
+	tagBool
+	tagInt
+	tagFloat
+	tagStr
+	tagChar
+	tagSymbol
+	tagList
+	tagArray
+	tagHash
+	tagBytes
+	tagFunction
+	tagGoFunction
+)
+
+// instruction fields present in the encoding
+const (
+	hasExpr = 1 << iota
+	hasClosedFunc
+	hasSym
+	hasIsSet
+	hasNargs
+	hasLoc
+	hasDirection
+	hasErr
+	hasDynamicErr
+	hasPos
+	hasDepth
+	hasSlot
+	hasFrame
+)
+
+// bytecodeWriter keeps the first error, the output is discarded once one
+// occurred. Strings and positions are written once and referred to by index
+// afterwards.
+type bytecodeWriter struct {
+	w    *bufio.Writer
+	strs map[string]int
+	poss map[*Position]int
+	err  error
+}
+
+func (bw *bytecodeWriter) fail(err error) {
+	if bw.err == nil {
+		bw.err = err
+	}
+}
+
+func (bw *bytecodeWriter) uvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	bw.w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func (bw *bytecodeWriter) varint(x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	bw.w.Write(buf[:binary.PutVarint(buf[:], x)])
+}
+
+func (bw *bytecodeWriter) bool(b bool) {
+	if b {
+		bw.w.WriteByte(1)
+	} else {
+		bw.w.WriteByte(0)
+	}
+}
+
+func (bw *bytecodeWriter) bytes(b []byte) {
+	bw.uvarint(uint64(len(b)))
+	bw.w.Write(b)
+}
+
+func (bw *bytecodeWriter) str(s string) {
+	if i, ok := bw.strs[s]; ok {
+		bw.uvarint(uint64(i) + 1)
+		return
+	}
+	bw.strs[s] = len(bw.strs)
+	bw.uvarint(0)
+	bw.bytes([]byte(s))
+}
+
+func (bw *bytecodeWriter) pos(p *Position) {
+	if p == nil {
+		bw.uvarint(0)
+		return
+	}
+	if i, ok := bw.poss[p]; ok {
+		bw.uvarint(uint64(i) + 2)
+		return
+	}
+	bw.poss[p] = len(bw.poss)
+	bw.uvarint(1)
+	bw.str(p.File)
+	bw.varint(int64(p.Line))
+	bw.varint(int64(p.Col))
+}
+
+func (bw *bytecodeWriter) function(f *SexpFunction) {
+	if f.closeScope != nil {
+		bw.fail(fmt.Errorf("cannot compile closure %s", f.name))
+		return
+	}
+	bw.str(f.name)
+	bw.varint(int64(f.nargs))
+	bw.bool(f.varargs)
+	bw.str(f.doc)
+	bw.uvarint(uint64(len(f.arities)))
+	for _, body := range f.arities {
+		bw.function(body)
+	}
+	bw.frame(f.frame)
+	bw.uvarint(uint64(len(f.fun)))
+	for _, instr := range f.fun {
+		bw.instruction(instr)
+	}
+}
+
+func (bw *bytecodeWriter) frame(f *Frame) {
+	bw.uvarint(uint64(f.size()))
+	for i := 0; i < f.size(); i++ {
+		bw.str(f.names[i].name)
+	}
+}
+
+func (bw *bytecodeWriter) instruction(instr Instruction) {
+	var fields uint64
+	set := func(field uint64, present bool) {
+		if present {
+			fields |= field
+		}
+	}
+	set(hasExpr, instr.Expr != nil)
+	set(hasClosedFunc, instr.ClosedFunc != nil)
+	set(hasSym, instr.Sym.name != "")
+	set(hasIsSet, instr.IsSet)
+	set(hasNargs, instr.Nargs != 0)
+	set(hasLoc, instr.Loc != 0)
+	set(hasDirection, instr.Direction)
+	set(hasErr, instr.Err != nil)
+	set(hasDynamicErr, instr.DynamicErr)
+	set(hasPos, instr.Pos != nil)
+	set(hasDepth, instr.Depth != 0)
+	set(hasSlot, instr.Slot != 0)
+	set(hasFrame, instr.Frame != nil)
+
+	bw.w.WriteByte(byte(instr.Op))
+	bw.uvarint(fields)
+	if instr.Expr != nil {
+		bw.sexp(instr.Expr)
+	}
+	if instr.ClosedFunc != nil {
+		bw.function(instr.ClosedFunc)
+	}
+	if fields&hasSym != 0 {
+		bw.str(instr.Sym.name)
+	}
+	if fields&hasNargs != 0 {
+		bw.varint(int64(instr.Nargs))
+	}
+	if fields&hasLoc != 0 {
+		bw.varint(int64(instr.Loc))
+	}
+	if instr.Err != nil {
+		bw.str(instr.Err.Error())
+	}
+	if instr.Pos != nil {
+		bw.pos(instr.Pos)
+	}
+	if fields&hasDepth != 0 {
+		bw.uvarint(uint64(instr.Depth))
+	}
+	if fields&hasSlot != 0 {
+		bw.uvarint(uint64(instr.Slot))
+	}
+	if instr.Frame != nil {
+		bw.frame(instr.Frame)
+	}
+}
+
+func (bw *bytecodeWriter) sexp(expr Sexp) {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		bw.w.WriteByte(tagSentinel)
+		bw.varint(int64(e))
+	case SexpBool:
+		bw.w.WriteByte(tagBool)
+		bw.bool(bool(e))
+	case SexpInt:
+		data, _ := e.toBig().GobEncode()
+		bw.w.WriteByte(tagInt)
+		bw.bytes(data)
+	case SexpFloat:
+		data, err := e.v.GobEncode()
+		if err != nil {
+			bw.fail(err)
+			return
+		}
+		bw.w.WriteByte(tagFloat)
+		bw.bytes(data)
+		bw.str(e.rawStr)
+	case SexpStr:
+		bw.w.WriteByte(tagStr)
+		bw.str(string(e))
+	case SexpChar:
+		bw.w.WriteByte(tagChar)
+		bw.varint(int64(e))
+	case SexpSymbol:
+		bw.w.WriteByte(tagSymbol)
+		bw.str(e.name)
+	case *SexpPair:
+		// write the pairs of a list in a row to keep long lists flat
+		var pairs []*SexpPair
+		var tail Sexp = e
+		for pair, ok := tail.(*SexpPair); ok; pair, ok = tail.(*SexpPair) {
+			pairs = append(pairs, pair)
+			tail = pair.tail
+		}
+		bw.w.WriteByte(tagList)
+		bw.uvarint(uint64(len(pairs)))
+		for _, pair := range pairs {
+			bw.sexp(pair.head)
+			bw.pos(pair.pos)
+		}
+		bw.sexp(tail)
+	case SexpArray:
+		bw.w.WriteByte(tagArray)
+		bw.uvarint(uint64(len(e)))
+		for _, elem := range e {
+			bw.sexp(elem)
+		}
+	case *SexpHash:
+		bw.w.WriteByte(tagHash)
+		bw.uvarint(uint64(len(e.Map)))
+		e.Visit(func(k, v Sexp) bool {
+			bw.sexp(k)
+			bw.sexp(v)
+			return true
+		})
+	case SexpBytes:
+		bw.w.WriteByte(tagBytes)
+		bw.bytes(e.bytes)
+	case *SexpFunction:
+		if e.user {
+			bw.w.WriteByte(tagGoFunction)
+			bw.str(e.name)
+			return
+		}
+		bw.w.WriteByte(tagFunction)
+		bw.function(e)
+	default:
+		bw.fail(fmt.Errorf("cannot compile constant of type %s", InspectType(expr)))
+	}
+}
+
+// bytecodeReader keeps the first error, later reads return zero values.
+type bytecodeReader struct {
+	env  *Environment
+	r    *bufio.Reader
+	strs []string
+	poss []*Position
+	err  error
+}
+
+func (br *bytecodeReader) fail(err error) {
+	if br.err == nil {
+		br.err = err
+	}
+}
+
+func (br *bytecodeReader) byte() byte {
+	if br.err != nil {
+		return 0
+	}
+	b, err := br.r.ReadByte()
+	if err != nil {
+		br.fail(io.ErrUnexpectedEOF)
+	}
+	return b
+}
+
+func (br *bytecodeReader) uvarint() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		br.fail(io.ErrUnexpectedEOF)
+	}
+	return x
+}
+
+func (br *bytecodeReader) varint() int64 {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(br.r)
+	if err != nil {
+		br.fail(io.ErrUnexpectedEOF)
+	}
+	return x
+}
+
+func (br *bytecodeReader) bool() bool {
+	return br.byte() != 0
+}
+
+// count reads a length, slices are grown while their elements are read so
+// corrupted input cannot make the reader allocate huge slices up front.
+func (br *bytecodeReader) count() int {
+	n := br.uvarint()
+	if br.err == nil && n > 1<<31 {
+		br.fail(errors.New("length out of range"))
+	}
+	if br.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (br *bytecodeReader) bytes() []byte {
+	n := br.count()
+	if br.err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, br.r, int64(n)); err != nil {
+		br.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func (br *bytecodeReader) str() string {
+	i := br.uvarint()
+	if br.err != nil {
+		return ""
+	}
+	if i == 0 {
+		s := string(br.bytes())
+		br.strs = append(br.strs, s)
+		return s
+	}
+	if i > uint64(len(br.strs)) {
+		br.fail(errors.New("bad string reference"))
+		return ""
+	}
+	return br.strs[i-1]
+}
+
+func (br *bytecodeReader) pos() *Position {
+	i := br.uvarint()
+	switch {
+	case br.err != nil || i == 0:
+		return nil
+	case i == 1:
+		p := &Position{File: br.str(), Line: int(br.varint()), Col: int(br.varint())}
+		br.poss = append(br.poss, p)
+		return p
+	case i-2 < uint64(len(br.poss)):
+		return br.poss[i-2]
+	}
+	br.fail(errors.New("bad position reference"))
+	return nil
+}
+
+func (br *bytecodeReader) function() *SexpFunction {
+	name := br.str()
+	nargs := int(br.varint())
+	varargs := br.bool()
+	doc := br.str()
+	var arities []*SexpFunction
+	for i, n := 0, br.count(); i < n && br.err == nil; i++ {
+		arities = append(arities, br.function())
+	}
+	frame := br.frame()
+	n := br.count()
+	fun := make(Function, 0)
+	for i := 0; i < n && br.err == nil; i++ {
+		fun = append(fun, br.instruction())
+	}
+	f := MakeFunction(name, nargs, varargs, fun, WithDoc(doc), withFrame(frame))
+	f.arities = arities
+	return f
+}
+
+func (br *bytecodeReader) frame() *Frame {
+	n := br.count()
+	frame := &Frame{}
+	for i := 0; i < n && br.err == nil; i++ {
+		frame.names = append(frame.names, br.env.MakeSymbol(br.str()))
+	}
+	return frame
+}
+
+// goFunction looks up a Go function embedded in the code by a macro, it must
+// be registered by AddInternalFunction, bound under its name in the global
+// scope or be a builtin.
+func (br *bytecodeReader) goFunction(name string) Sexp {
+	if br.err != nil {
+		return SexpNull
+	}
+	sym := br.env.MakeSymbol(name)
+	if f, ok := br.env.internals[sym.number]; ok {
+		return f
+	}
+	if expr, err := br.env.scopestack.LookupSymbol(sym); err == nil && IsFunction(expr) {
+		return expr
+	}
+	if f, ok := br.env.builtins[sym.number]; ok {
+		return f
+	}
+	br.fail(fmt.Errorf("Go function %s not found", name))
+	return SexpNull
+}
+
+func (br *bytecodeReader) instruction() Instruction {
+	instr := Instruction{Op: Opcode(br.byte())}
+	fields := br.uvarint()
+	if fields&hasExpr != 0 {
+		instr.Expr = br.sexp()
+	}
+	if fields&hasClosedFunc != 0 {
+		instr.ClosedFunc = br.function()
+	}
+	if fields&hasSym != 0 {
+		instr.Sym = br.env.MakeSymbol(br.str())
+	}
+	instr.IsSet = fields&hasIsSet != 0
+	if fields&hasNargs != 0 {
+		instr.Nargs = int(br.varint())
+	}
+	if fields&hasLoc != 0 {
+		instr.Loc = int(br.varint())
+	}
+	instr.Direction = fields&hasDirection != 0
+	if fields&hasErr != 0 {
+		instr.Err = errors.New(br.str())
+	}
+	instr.DynamicErr = fields&hasDynamicErr != 0
+	if fields&hasPos != 0 {
+		instr.Pos = br.pos()
+	}
+	if fields&hasDepth != 0 {
+		instr.Depth = br.count()
+	}
+	if fields&hasSlot != 0 {
+		instr.Slot = br.count()
+	}
+	if fields&hasFrame != 0 {
+		instr.Frame = br.frame()
+	}
+	if needsCallCache(instr.Op) {
+		instr.Cache = &callCache{}
+	}
+	return instr
+}
+
+func (br *bytecodeReader) sexp() Sexp {
+	switch tag := br.byte(); tag {
+	case tagSentinel:
+		return SexpSentinel(br.varint())
+	case tagBool:
+		return SexpBool(br.bool())
+	case tagInt:
+		v := new(big.Int)
+		if err := v.GobDecode(br.bytes()); err != nil {
+			br.fail(err)
+		}
+		return newSexpIntBig(v)
+	case tagFloat:
+		v := new(big.Float)
+		if err := v.GobDecode(br.bytes()); err != nil {
+			br.fail(err)
+		}
+		return SexpFloat{v: v, rawStr: br.str()}
+	case tagStr:
+		return SexpStr(br.str())
+	case tagChar:
+		return SexpChar(br.varint())
+	case tagSymbol:
+		return br.env.MakeSymbol(br.str())
+	case tagList:
+		n := br.count()
+		heads := make([]Sexp, 0)
+		poss := make([]*Position, 0)
+		for i := 0; i < n && br.err == nil; i++ {
+			heads = append(heads, br.sexp())
+			poss = append(poss, br.pos())
+		}
+		list := br.sexp()
+		for i := len(heads) - 1; i >= 0; i-- {
+			list = &SexpPair{head: heads[i], tail: list, pos: poss[i]}
+		}
+		return list
+	case tagArray:
+		n := br.count()
+		arr := make(SexpArray, 0)
+		for i := 0; i < n && br.err == nil; i++ {
+			arr = append(arr, br.sexp())
+		}
+		return arr
+	case tagHash:
+		n := br.count()
+		hash, _ := MakeHash(MakeArgs())
+		for i := 0; i < n && br.err == nil; i++ {
+			k, v := br.sexp(), br.sexp()
+			if err := hash.HashSet(k, v); err != nil {
+				br.fail(err)
+			}
+		}
+		return hash
+	case tagBytes:
+		return SexpBytes{bytes: br.bytes()}
+	case tagFunction:
+		return br.function()
+	case tagGoFunction:
+		return br.goFunction(br.str())
+	default:
+		br.fail(fmt.Errorf("bad constant tag %d", tag))
+	}
+	return SexpNull
+}
@@ -74,7 +74,7 @@ func compareFloatAndInt(f SexpFloat, e SexpInt) int {
 }
 
 func compareBetweenInt(f, e SexpInt) int {
-	return f.v.Cmp(e.v)
+	return f.cmp(e)
 }
 
 func compareInt(i SexpInt, expr Sexp) (int, error) {
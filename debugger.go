@@ -0,0 +1,239 @@
+package glisp
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DebugAction tells Run how to go on after a pause.
+type DebugAction int
+
+const (
+	// DebugContinue runs until the next breakpoint.
+	DebugContinue DebugAction = iota
+	// DebugStepInto pauses at the next expression, entering calls.
+	DebugStepInto
+	// DebugStepOver pauses at the next expression of the current function.
+	DebugStepOver
+	// DebugStepOut pauses once the current function returns.
+	DebugStepOut
+	// DebugAbort stops the evaluation with ErrDebugAbort.
+	DebugAbort
+)
+
+// ErrDebugAbort is returned by Run when the debugger aborts the evaluation.
+var ErrDebugAbort = errors.New("evaluation aborted by debugger")
+
+// Pause describes where Run stopped. The environment must only be
+// inspected until the handler returns.
+type Pause struct {
+	Env      *Environment
+	Reason   string // "breakpoint", "step" or "break"
+	Function string
+	PC       int
+	Pos      Position
+	// Depth is the number of active calls below the paused function
+	Depth int
+}
+
+// DebugHandler is called on every pause and blocks Run until it returns.
+type DebugHandler func(*Pause) DebugAction
+
+// Debugger pauses Run at breakpoints and while stepping. Attach it with
+// AttachDebugger, Run checks it before every instruction only while it is
+// attached.
+type Debugger struct {
+	mu         sync.Mutex
+	handler    DebugHandler
+	funcBreaks map[string]bool
+	lineBreaks map[Position]bool
+	mode       DebugAction
+	requested  bool
+	// depth and pos describe the last pause, prev the last position run
+	depth int
+	pos   *Position
+	prev  *Position
+	// entering is set by a function breakpoint waiting for the first
+	// expression of the function body at depth entered
+	entering bool
+	entered  int
+}
+
+func NewDebugger(handler DebugHandler) *Debugger {
+	return &Debugger{
+		handler:    handler,
+		funcBreaks: make(map[string]bool),
+		lineBreaks: make(map[Position]bool),
+	}
+}
+
+// BreakOnFunction pauses at the first expression of the script function
+// name whenever it is called.
+func (d *Debugger) BreakOnFunction(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcBreaks[name] = true
+}
+
+// BreakOnLine pauses whenever execution reaches line of file, an empty
+// file matches every file.
+func (d *Debugger) BreakOnLine(file string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lineBreaks[Position{File: file, Line: line}] = true
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcBreaks = make(map[string]bool)
+	d.lineBreaks = make(map[Position]bool)
+}
+
+// Breakpoints returns the breakpoints as "function" or "file:line" strings.
+func (d *Debugger) Breakpoints() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ret []string
+	for name := range d.funcBreaks {
+		ret = append(ret, name)
+	}
+	for pos := range d.lineBreaks {
+		if pos.File == "" {
+			ret = append(ret, "line "+strconv.Itoa(pos.Line))
+		} else {
+			ret = append(ret, pos.File+":"+strconv.Itoa(pos.Line))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Break pauses Run before the next instruction.
+func (d *Debugger) Break() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requested = true
+}
+
+// AttachDebugger makes Run consult d before every instruction, nil detaches
+// the debugger. Environments created by Clone share it.
+func (env *Environment) AttachDebugger(d *Debugger) {
+	env.debugger = d
+	env.nextCheckpoint = env.ticks
+}
+
+// Debugger returns the attached debugger or nil.
+func (env *Environment) Debugger() *Debugger {
+	return env.debugger
+}
+
+func (d *Debugger) check(env *Environment) error {
+	instr := env.curfunc.fun[env.pc]
+	depth := env.addrstack.Top()
+
+	d.mu.Lock()
+	reason := d.pauseReason(env, instr.Pos, depth)
+	if instr.Pos != nil {
+		d.prev = instr.Pos
+	}
+	d.mu.Unlock()
+	if reason == "" {
+		return nil
+	}
+
+	pause := &Pause{
+		Env:      env,
+		Reason:   reason,
+		Function: env.curfunc.name,
+		PC:       env.pc,
+		Depth:    depth,
+	}
+	if instr.Pos != nil {
+		pause.Pos = *instr.Pos
+	}
+	action := d.handler(pause)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if action == DebugAbort {
+		d.mode = DebugContinue
+		return ErrDebugAbort
+	}
+	d.mode = action
+	d.depth = depth
+	d.pos = instr.Pos
+	return nil
+}
+
+func (d *Debugger) pauseReason(env *Environment, pos *Position, depth int) string {
+	if d.requested {
+		d.requested = false
+		return "break"
+	}
+	moved := pos != nil && (d.pos == nil || *pos != *d.pos)
+	switch d.mode {
+	case DebugStepInto:
+		if moved {
+			return "step"
+		}
+	case DebugStepOver:
+		if moved && depth <= d.depth || pos != nil && depth < d.depth {
+			return "step"
+		}
+	case DebugStepOut:
+		if pos != nil && depth < d.depth {
+			return "step"
+		}
+	}
+	// pause on the body of the function, once its arguments are bound
+	if env.pc == 0 && d.funcBreaks[env.curfunc.name] {
+		d.entering, d.entered = true, depth
+	}
+	if d.entering && pos != nil && d.entered == depth {
+		d.entering = false
+		return "breakpoint"
+	}
+	if pos != nil && len(d.lineBreaks) > 0 && (d.prev == nil || d.prev.Line != pos.Line || d.prev.File != pos.File) {
+		if d.lineBreaks[Position{File: pos.File, Line: pos.Line}] || d.lineBreaks[Position{Line: pos.Line}] {
+			return "breakpoint"
+		}
+	}
+	return ""
+}
+
+// Binding is a variable visible from the current scope.
+type Binding struct {
+	Name  string
+	Value Sexp
+}
+
+// LocalBindings returns the bindings of all scopes but the global one,
+// innermost scope first.
+func (env *Environment) LocalBindings() []Binding {
+	var ret []Binding
+	for layer := env.scopestack.top; layer != nil && layer != env.scopestack.bottom; layer = layer.next {
+		start := len(ret)
+		for num, val := range layer.Scope {
+			ret = append(ret, Binding{Name: env.symbols.name(num), Value: val})
+		}
+		for i, val := range layer.slots {
+			if val != nil {
+				ret = append(ret, Binding{Name: layer.frame.names[i].name, Value: val})
+			}
+		}
+		scope := ret[start:]
+		sort.Slice(scope, func(i, j int) bool { return scope[i].Name < scope[j].Name })
+	}
+	return ret
+}
+
+// DataStackValues returns the values on the data stack, bottom first.
+func (env *Environment) DataStackValues() []Sexp {
+	ret := make([]Sexp, env.datastack.Top()+1)
+	copy(ret, env.datastack.elements)
+	return ret
+}
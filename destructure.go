@@ -0,0 +1,310 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Destructuring patterns bind the parts of a value in let, let*, fn and
+// defn. An array pattern [a b & more :as all] takes the elements of an
+// array or a list, a hash pattern {a "a" b :b :keys [c d] :or {d 1} :as all}
+// takes the values of a hash, and records by their field names. Patterns
+// nest, missing elements and keys are bound to nil.
+
+// explainer is a value with colon accessors, such as a record, (:name x)
+// reads its field name.
+type explainer interface {
+	Explain(env *Environment, field string, args Args) (Sexp, error)
+}
+
+// fieldHolder is an explainer knowing the fields it has, a field it lacks
+// is missing rather than an error.
+type fieldHolder interface {
+	HasField(name string) bool
+}
+
+func isSymbolNamed(expr Sexp, name string) bool {
+	sym, ok := expr.(SexpSymbol)
+	return ok && sym.name == name
+}
+
+// isHashPattern reports whether expr is a hash pattern, {...} is read as
+// (hash ...).
+func isHashPattern(expr Sexp) bool {
+	pair, ok := expr.(*SexpPair)
+	return ok && isSymbolNamed(pair.head, "hash")
+}
+
+// bindValues binds patterns to as many values on the stack, the last one
+// on top. Symbols are bound first, then the destructured values in order so
+// the defaults of a pattern see the names bound before it.
+func (gen *Generator) bindValues(patterns []Sexp) error {
+	hidden := make([]SexpSymbol, len(patterns))
+	for i := len(patterns) - 1; i >= 0; i-- {
+		sym, ok := patterns[i].(SexpSymbol)
+		if !ok {
+			sym = gen.env.GenSymbol("__destructure")
+			hidden[i] = sym
+		}
+		gen.AddInstruction(gen.bindInstruction(sym))
+	}
+	for i, sym := range hidden {
+		if sym.name == "" {
+			continue
+		}
+		gen.AddInstruction(gen.getInstruction(sym))
+		if err := gen.generateBinding(patterns[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateBinding pops the value on top of the stack and binds pattern
+// to it.
+func (gen *Generator) generateBinding(pattern Sexp) error {
+	switch p := pattern.(type) {
+	case SexpSymbol:
+		gen.AddInstruction(gen.bindInstruction(p))
+		return nil
+	case SexpArray:
+		return gen.generateSeqBinding(p)
+	case *SexpPair:
+		if isHashPattern(p) {
+			return gen.generateHashBinding(p)
+		}
+	}
+	return fmt.Errorf("cannot bind to %s", pattern.SexpString())
+}
+
+func (gen *Generator) generateSeqBinding(pattern SexpArray) error {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case isSymbolNamed(pattern[i], ":as"):
+			if i+2 != len(pattern) {
+				return errors.New(":as must be followed by a symbol ending the pattern")
+			}
+			if err := gen.generateAs(pattern[i+1]); err != nil {
+				return err
+			}
+			i++
+		case isSymbolNamed(pattern[i], "&"):
+			if i+1 == len(pattern) || isSymbolNamed(pattern[i+1], ":as") {
+				return errors.New("& must be followed by a pattern")
+			}
+			if i+2 < len(pattern) && !isSymbolNamed(pattern[i+2], ":as") {
+				return errors.New("only :as may follow the rest of a pattern")
+			}
+			gen.AddInstruction(Instruction{Op: OpDup})
+			gen.AddInstruction(Instruction{Op: OpUnpackRest, Nargs: n})
+			if err := gen.generateBinding(pattern[i+1]); err != nil {
+				return err
+			}
+			i++
+		default:
+			gen.AddInstruction(Instruction{Op: OpDup})
+			gen.AddInstruction(Instruction{Op: OpUnpackNth, Nargs: n})
+			if err := gen.generateBinding(pattern[i]); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	gen.AddInstruction(Instruction{Op: OpPop})
+	return nil
+}
+
+func (gen *Generator) generateHashBinding(pattern *SexpPair) error {
+	items, err := ListToArray(pattern.tail)
+	if err != nil {
+		return err
+	}
+	if len(items)%2 != 0 {
+		return errors.New("uneven hash pattern")
+	}
+	defaults := make(map[int]Sexp)
+	for i := 0; i < len(items); i += 2 {
+		if !isSymbolNamed(items[i], ":or") {
+			continue
+		}
+		if !isHashPattern(items[i+1]) {
+			return errors.New(":or must be followed by a hash of defaults")
+		}
+		kvs, err := ListToArray(items[i+1].(*SexpPair).tail)
+		if err != nil {
+			return err
+		}
+		if len(kvs)%2 != 0 {
+			return errors.New("uneven :or defaults")
+		}
+		for j := 0; j < len(kvs); j += 2 {
+			sym, ok := kvs[j].(SexpSymbol)
+			if !ok {
+				return fmt.Errorf(":or default must be given to a symbol but got %s", InspectType(kvs[j]))
+			}
+			defaults[sym.number] = kvs[j+1]
+		}
+	}
+
+	for i := 0; i < len(items); i += 2 {
+		switch {
+		case isSymbolNamed(items[i], ":or"):
+		case isSymbolNamed(items[i], ":as"):
+			if err := gen.generateAs(items[i+1]); err != nil {
+				return err
+			}
+		case isSymbolNamed(items[i], ":keys"):
+			names, ok := items[i+1].(SexpArray)
+			if !ok {
+				return errors.New(":keys must be followed by an array of symbols")
+			}
+			for _, name := range names {
+				sym, ok := name.(SexpSymbol)
+				if !ok {
+					return fmt.Errorf(":keys must be followed by an array of symbols but got %s", InspectType(name))
+				}
+				if err := gen.generateKeyBinding(sym, SexpStr(sym.name), defaults); err != nil {
+					return err
+				}
+			}
+		default:
+			key, err := patternKey(items[i+1])
+			if err != nil {
+				return err
+			}
+			if err := gen.generateKeyBinding(items[i], key, defaults); err != nil {
+				return err
+			}
+		}
+	}
+	gen.AddInstruction(Instruction{Op: OpPop})
+	return nil
+}
+
+// generateKeyBinding binds pattern to the value of key, the default code
+// runs only when the key is missing.
+func (gen *Generator) generateKeyBinding(pattern Sexp, key Sexp, defaults map[int]Sexp) error {
+	var dflt Sexp = SexpNull
+	if sym, ok := pattern.(SexpSymbol); ok {
+		if expr, ok := defaults[sym.number]; ok {
+			dflt = expr
+		}
+	}
+	subgen := gen.subGenerator()
+	subgen.scopes = gen.scopes
+	subgen.funcname = gen.funcname
+	if err := subgen.Generate(dflt); err != nil {
+		return err
+	}
+	gen.AddInstruction(Instruction{Op: OpDup})
+	gen.AddInstruction(Instruction{Op: OpUnpackKey, Expr: key, Loc: len(subgen.instructions) + 1})
+	gen.AddInstructions(subgen.instructions)
+	return gen.generateBinding(pattern)
+}
+
+func (gen *Generator) generateAs(expr Sexp) error {
+	sym, ok := expr.(SexpSymbol)
+	if !ok {
+		return fmt.Errorf(":as must be followed by a symbol but got %s", InspectType(expr))
+	}
+	gen.AddInstruction(Instruction{Op: OpDup})
+	gen.AddInstruction(gen.bindInstruction(sym))
+	return nil
+}
+
+// patternKey returns the key a hash pattern looks up. Strings and :name
+// are field names, looked up as strings then as symbols like (:name h),
+// other keys are looked up as they are.
+func patternKey(expr Sexp) (Sexp, error) {
+	switch e := expr.(type) {
+	case SexpStr, SexpInt, SexpChar, SexpBool:
+		return e, nil
+	case SexpSymbol:
+		if strings.HasPrefix(e.name, ":") && len(e.name) > 1 {
+			return SexpStr(e.name[1:]), nil
+		}
+	case *SexpPair:
+		if isSymbolNamed(e.head, "quote") {
+			if tail, ok := e.tail.(*SexpPair); ok {
+				if sym, ok := tail.head.(SexpSymbol); ok {
+					return sym, nil
+				}
+			}
+		}
+	}
+	return SexpNull, fmt.Errorf("hash pattern key must be a string, :name or quoted symbol but got %s", expr.SexpString())
+}
+
+// unpackNth returns element n of a sequence, or the elements from n on
+// if rest is set, nil past its end.
+func unpackNth(expr Sexp, n int, rest bool) (Sexp, error) {
+	switch e := expr.(type) {
+	case SexpArray:
+		switch {
+		case n >= len(e):
+			return SexpNull, nil
+		case rest:
+			return e[n:], nil
+		default:
+			return e[n], nil
+		}
+	case *SexpPair:
+		var list Sexp = e
+		for ; n > 0; n-- {
+			pair, ok := list.(*SexpPair)
+			if !ok {
+				return SexpNull, nil
+			}
+			list = pair.tail
+		}
+		if rest {
+			return list, nil
+		}
+		if pair, ok := list.(*SexpPair); ok {
+			return pair.head, nil
+		}
+		return SexpNull, nil
+	}
+	if expr == SexpNull {
+		return SexpNull, nil
+	}
+	return SexpNull, fmt.Errorf("cannot destructure %s as a sequence", InspectType(expr))
+}
+
+// unpackKey returns the value of key in a hash or a record, found is false
+// if it is missing.
+func (env *Environment) unpackKey(expr Sexp, key Sexp) (val Sexp, found bool, err error) {
+	if expr == SexpNull {
+		return SexpNull, false, nil
+	}
+	name, isName := key.(SexpStr)
+	switch e := expr.(type) {
+	case *SexpHash:
+		if val, err = e.HashGetDefault(key, SexpEnd); err != nil {
+			return SexpNull, false, err
+		}
+		if val == SexpEnd && isName {
+			if val, err = e.HashGetDefault(env.MakeSymbol(string(name)), SexpEnd); err != nil {
+				return SexpNull, false, err
+			}
+		}
+		if val == SexpEnd {
+			return SexpNull, false, nil
+		}
+		return val, true, nil
+	case explainer:
+		if !isName {
+			return SexpNull, false, fmt.Errorf("cannot destructure %s by key %s", InspectType(expr), key.SexpString())
+		}
+		if f, ok := e.(fieldHolder); ok && !f.HasField(string(name)) {
+			return SexpNull, false, nil
+		}
+		if val, err = e.Explain(env, string(name), MakeArgs()); err != nil {
+			return SexpNull, false, err
+		}
+		return val, true, nil
+	}
+	return SexpNull, false, fmt.Errorf("cannot destructure %s as a hash", InspectType(expr))
+}
@@ -0,0 +1,85 @@
+package glisp
+
+import "sync"
+
+// EnvPool hands out environments for concurrent evaluation, all children
+// of a template environment with extensions imported and scripts loaded,
+// see NewChild. Def, set! of globals and bindings made through the Go API
+// never reach the template or another environment of the pool. Values
+// bound in the template, such as hashes and arrays, are shared and should
+// not be mutated, and so are the variables captured by closures made in
+// the template: set! of n in the counter of
+//
+//	(def counter (let [n 0] (fn [] (set! n (+ n 1)) n)))
+//
+// is seen by every environment of the pool. The template must not be used
+// once the pool is created.
+type EnvPool struct {
+	template *Environment
+	pool     sync.Pool
+}
+
+// NewEnvPool creates a pool of environments made from template.
+func NewEnvPool(template *Environment) *EnvPool {
+	p := &EnvPool{template: template}
+	p.pool.New = func() any {
+		return p.newEnv()
+	}
+	return p
+}
+
+// Get returns an environment of the pool, it is not safe for concurrent
+// use and should be given back with Put once the evaluation is done.
+func (p *EnvPool) Get() *Environment {
+	return p.pool.Get().(*Environment)
+}
+
+// Put resets env, dropping the bindings it made, and returns it to the pool.
+// Environments not taken from p are ignored.
+func (p *EnvPool) Put(env *Environment) {
+	if env == nil || env.pool != p {
+		return
+	}
+	p.reset(env)
+	p.pool.Put(env)
+}
+
+func (p *EnvPool) newEnv() *Environment {
+	env := p.template.NewChild()
+	env.pool = p
+	return env
+}
+
+// reset gives env a fresh global scope over the template's, and drops the
+// macros, types and namespaces it defined.
+func (p *EnvPool) reset(env *Environment) {
+	t := p.template
+	if env.scopestack != nil {
+		env.scopestack.Clear()
+	}
+	for !env.stackstack.IsEmpty() {
+		scopestack, _ := env.stackstack.Pop()
+		scopestack.Clear()
+	}
+	env.scopestack = t.scopestack.ForkGlobal()
+	clear(env.datastack.elements)
+	env.datastack.tos = -1
+	env.addrstack.tos = -1
+	env.handlers = nil
+	env.depth = 0
+	env.ctx = nil
+	env.debugger = nil
+	env.profiler = nil
+
+	env.macros = t.macros.Child()
+	env.namespaces = t.namespaces.child()
+	env.values = t.values
+	clear(env.typeAlias)
+	env.ticks, env.flushedTicks, env.nextCheckpoint = 0, 0, 0
+	env.budget.reset(t.budget.currentLimit())
+	env.quota.store(*t.quota.load())
+
+	env.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
+	env.curfunc = env.mainfunc
+	env.pc = 0
+}
@@ -3,30 +3,64 @@ package glisp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strconv"
+	"reflect"
 	"strings"
-	"sync/atomic"
 )
 
 type Environment struct {
-	datastack   *DataStack
-	scopestack  *ScopeStack
-	addrstack   *AddrStack
-	stackstack  *StackStack
-	symtable    map[string]int
-	revsymtable map[int]string
-	builtins    map[int]*SexpFunction
-	macros      *FuncMap
-	curfunc     *SexpFunction
-	mainfunc    *SexpFunction
-	pc          int
-	nextsymbol  *nextSymbol
-	fileReader  FileReader
-	typeAlias   map[string]string
+	datastack  *DataStack
+	scopestack *ScopeStack
+	addrstack  *AddrStack
+	stackstack *StackStack
+	symbols    *symbolTable
+	builtins   map[int]*SexpFunction
+	// internals holds the Go functions macros embed in their expansions,
+	// the map is replaced rather than changed
+	internals  map[int]*SexpFunction
+	macros     *FuncMap
+	curfunc    *SexpFunction
+	mainfunc   *SexpFunction
+	pc         int
+	fileReader FileReader
+	typeAlias  map[string]string
+	ctx        context.Context
+	// ticks counts instructions executed by Run, checkpoint runs once
+	// ticks reaches nextCheckpoint.
+	ticks          int64
+	flushedTicks   int64
+	nextCheckpoint int64
+	budget         *instrBudget
+	quota          *sharedQuota
+	// handlers holds the error handlers installed by try, depth is the
+	// number of nested Run calls and tells which run owns a handler.
+	handlers []tryHandler
+	depth    int
+	debugger *Debugger
+	profiler *Profiler
+	// noOptimize turns off the optimization of generated code
+	noOptimize bool
+	limits     stackLimits
+	// pool is the pool the environment was taken from
+	pool *EnvPool
+	// parent is the environment a child made by NewChild finds the
+	// globals, macros and type names it does not have itself in
+	parent *Environment
+	// values holds the host values attached by SetValue
+	values *hostValue
+	// converters holds the Go types registered by RegisterGoConverter, the
+	// map is replaced rather than changed
+	converters map[reflect.Type]goConverter
+	// namespaces holds the namespaces declared and the modules required
+	namespaces *nsTable
+	// searchPath holds the roots files are looked up in, loading is the
+	// file being loaded, nil for code not read from a file
+	searchPath []FileReader
+	loading    *sourceFile
 }
 
 const CallStackSize = 25
@@ -34,20 +68,36 @@ const ScopeStackSize = 50
 const DataStackSize = 100
 const StackStackSize = 5
 
+// CheckpointInterval is the number of instructions Run executes between
+// two checks of the evaluation context.
+const CheckpointInterval = 256
+
 func New() *Environment {
+	return NewWithOptions()
+}
+
+// NewWithOptions creates an environment like New, opts set the initial
+// sizes and the maximums of its stacks. By default the stacks grow without
+// limit.
+func NewWithOptions(opts ...EnvOption) *Environment {
 	env := new(Environment)
-	env.datastack = NewDataStack(DataStackSize)
+	env.limits = defaultStackLimits()
+	for _, opt := range opts {
+		opt(&env.limits)
+	}
+	env.datastack = NewDataStack(env.limits.dataSize)
 	env.scopestack = NewScopeStack()
 	env.scopestack.PushScope()
-	env.stackstack = NewStackStack(StackStackSize)
-	env.addrstack = NewAddrStack(CallStackSize)
+	env.stackstack = NewStackStack(env.limits.stackSize)
+	env.addrstack = NewAddrStack(env.limits.callSize)
 	env.builtins = make(map[int]*SexpFunction)
 	env.macros = NewFuncMap()
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = &nextSymbol{counter: 1}
+	env.symbols = newSymbolTable()
 	env.fileReader = DefaultFileReader()
 	env.typeAlias = make(map[string]string)
+	env.namespaces = newNsTable()
+	env.budget = &instrBudget{}
+	env.quota = newSharedQuota(AllocQuota{})
 
 	for key, function := range BuiltinFunctions() {
 		sym := env.MakeSymbol(key)
@@ -71,18 +121,22 @@ func (env *Environment) Clone() *Environment {
 	dupenv.scopestack = env.scopestack.Clone()
 	dupenv.addrstack = env.addrstack.Clone()
 	dupenv.fileReader = env.fileReader
+	dupenv.searchPath = env.searchPath
+	dupenv.budget = &instrBudget{limit: env.budget.currentLimit()}
+	dupenv.quota = newSharedQuota(*env.quota.load())
+	dupenv.debugger = env.debugger
+	dupenv.profiler = env.profiler
+	dupenv.noOptimize = env.noOptimize
+	dupenv.limits = env.limits
+	dupenv.parent = env.parent
+	dupenv.values = env.values
+	dupenv.converters = env.converters
 
 	dupenv.builtins = copyFuncMap(env.builtins)
+	dupenv.internals = env.internals
 	dupenv.macros = env.macros.Clone()
-	dupenv.symtable = make(map[string]int)
-	for k, v := range env.symtable {
-		dupenv.symtable[k] = v
-	}
-	dupenv.revsymtable = make(map[int]string)
-	for k, v := range env.revsymtable {
-		dupenv.revsymtable[k] = v
-	}
-	dupenv.nextsymbol = env.nextsymbol.Clone()
+	dupenv.symbols = env.symbols.clone()
+	dupenv.namespaces = env.namespaces.clone()
 
 	dupenv.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	dupenv.curfunc = dupenv.mainfunc
@@ -96,19 +150,27 @@ func (env *Environment) Clone() *Environment {
 
 func (env *Environment) Duplicate() *Environment {
 	dupenv := new(Environment)
-	dupenv.datastack = NewDataStack(DataStackSize)
+	dupenv.datastack = NewDataStack(env.limits.dataSize)
 	dupenv.scopestack = env.scopestack.ForkBottom()
-	dupenv.stackstack = NewStackStack(StackStackSize)
-	dupenv.addrstack = NewAddrStack(CallStackSize)
+	dupenv.stackstack = NewStackStack(env.limits.stackSize)
+	dupenv.addrstack = NewAddrStack(env.limits.callSize)
 	dupenv.builtins = env.builtins
+	dupenv.internals = env.internals
 	dupenv.macros = env.macros.Clone()
 
 	// must use same symbolic table, nor new symbols in macro env would lost
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.symbols = env.symbols
+	dupenv.namespaces = env.namespaces
 	dupenv.fileReader = env.fileReader
+	dupenv.searchPath = env.searchPath
+	dupenv.ctx = env.ctx
+	dupenv.budget = env.budget
+	dupenv.quota = env.quota
+	dupenv.noOptimize = env.noOptimize
+	dupenv.limits = env.limits
+	dupenv.parent = env.parent
+	dupenv.values = env.values
+	dupenv.converters = env.converters
 
 	dupenv.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	dupenv.curfunc = dupenv.mainfunc
@@ -120,6 +182,41 @@ func (env *Environment) Duplicate() *Environment {
 	return dupenv
 }
 
+// NewChild creates an environment over the globals of env, taking the same
+// time however many of them there are. The global scope of env is frozen,
+// the child finds its bindings, macros and type names, while def, set!,
+// defmac and RegisterType in the child only change the child. The values
+// themselves, such as hashes and arrays, are shared, as are the variables
+// captured by the closures of env.
+func (env *Environment) NewChild() *Environment {
+	child := new(Environment)
+	child.parent = env
+	child.values = env.values
+	child.converters = env.converters
+	child.limits = env.limits
+	child.datastack = NewDataStack(env.limits.dataSize)
+	env.scopestack.Freeze()
+	child.scopestack = env.scopestack.ForkGlobal()
+	child.stackstack = NewStackStack(env.limits.stackSize)
+	child.addrstack = NewAddrStack(env.limits.callSize)
+	child.builtins = env.builtins
+	child.internals = env.internals
+	child.macros = env.macros.Child()
+	child.symbols = env.symbols
+	child.namespaces = env.namespaces.child()
+	child.fileReader = env.fileReader
+	child.searchPath = env.searchPath
+	child.noOptimize = env.noOptimize
+	child.budget = &instrBudget{limit: env.budget.currentLimit()}
+	child.quota = newSharedQuota(*env.quota.load())
+
+	child.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
+	child.curfunc = child.mainfunc
+	child.pc = 0
+	child.typeAlias = make(map[string]string)
+	return child
+}
+
 func (env *Environment) RegisterType(name string, exprs ...Sexp) {
 	for _, expr := range exprs {
 		env.typeAlias[getGoType(expr)] = name
@@ -129,23 +226,19 @@ func (env *Environment) RegisterType(name string, exprs ...Sexp) {
 func (env *Environment) GetTypeName(expr Sexp) string {
 	name := GetSexpType(expr)
 	if len(name) > 3 && name[:3] == "go:" {
-		if alias, ok := env.typeAlias[name]; ok {
-			return alias
+		for e := env; e != nil; e = e.parent {
+			if alias, ok := e.typeAlias[name]; ok {
+				return alias
+			}
 		}
 	}
 	return name
 }
 
+// MakeSymbol returns the symbol named name, it is safe for concurrent use
+// by environments sharing the symbol table.
 func (env *Environment) MakeSymbol(name string) SexpSymbol {
-	symnum, ok := env.symtable[name]
-	if ok {
-		return SexpSymbol{name, symnum}
-	}
-	symbol := SexpSymbol{name, int(env.nextsymbol.Get())}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-	env.nextsymbol.Incr()
-	return symbol
+	return SexpSymbol{name, env.symbols.intern(name)}
 }
 
 func (env *Environment) GenSymbol(optionalPrefix ...string) SexpSymbol {
@@ -153,8 +246,8 @@ func (env *Environment) GenSymbol(optionalPrefix ...string) SexpSymbol {
 	if len(optionalPrefix) > 0 && optionalPrefix[0] != "" {
 		prefix = optionalPrefix[0]
 	}
-	symname := prefix + strconv.FormatInt(env.nextsymbol.Get(), 10)
-	return env.MakeSymbol(symname)
+	name, num := env.symbols.gensym(prefix)
+	return SexpSymbol{name, num}
 }
 
 func (env *Environment) CurrentFunctionSize() int {
@@ -182,19 +275,53 @@ func (env *Environment) wrangleOptargs(fnargs, nargs int) error {
 }
 
 func (env *Environment) CallFunction(function *SexpFunction, nargs int) error {
-	if function.varargs {
-		err := env.wrangleOptargs(function.nargs, nargs)
+	body, err := env.prepareCall(function, nargs)
+	if err != nil {
+		return err
+	}
+	return env.enterFunction(function, body, nargs, min(env.pc+1, len(env.curfunc.fun)))
+}
+
+// prepareCall checks the number of arguments of a call of function and
+// gathers the optional ones, it returns the body to run.
+func (env *Environment) prepareCall(function *SexpFunction, nargs int) (*SexpFunction, error) {
+	// function defined with a body per arity runs the body, within the
+	// scope of function
+	body := function
+	if function.arities != nil {
+		var err error
+		if body, err = function.arity(nargs); err != nil {
+			return nil, err
+		}
+	}
+	if body.varargs {
+		err := env.wrangleOptargs(body.nargs, nargs)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else if nargs != function.nargs {
-		return fmt.Errorf("%s expected %d arguments, got %d",
-			function.name, function.nargs, nargs)
+	} else if nargs != body.nargs {
+		return nil, fmt.Errorf("%s expected %d arguments, got %d",
+			body.name, body.nargs, nargs)
 	}
+	return body, nil
+}
 
+// enterFunction starts body of function, returning to retpc of the
+// current function.
+func (env *Environment) enterFunction(function, body *SexpFunction, nargs int, retpc int) error {
 	if env.scopestack.IsEmpty() {
 		return errors.New("where's the global scope?")
 	}
+	if err := env.checkCall(function.name, true); err != nil {
+		return err
+	}
+	depth := 1
+	if function.closeScope != nil {
+		depth = function.closeScope.Depth()
+	}
+	if err := env.checkScope(function.name, depth+1); err != nil {
+		return err
+	}
 	env.stackstack.Push(env.scopestack)
 
 	if function.closeScope != nil {
@@ -203,10 +330,13 @@ func (env *Environment) CallFunction(function *SexpFunction, nargs int) error {
 		env.scopestack = env.scopestack.ForkBottom()
 	}
 
-	env.addrstack.PushAddr(env.curfunc, min(env.pc+1, len(env.curfunc.fun)))
-	env.scopestack.PushScope()
-	env.curfunc = function
+	env.addrstack.PushCall(env.curfunc, retpc, nargs)
+	env.scopestack.PushFrame(body.frame)
+	env.curfunc = body
 	env.pc = 0
+	if env.profiler != nil {
+		env.profiler.enter(body, body.name, env.addrstack.Top())
+	}
 
 	return nil
 }
@@ -221,7 +351,41 @@ func (env *Environment) BindGlobal(name string, expr Sexp) error {
 	if env.scopestack.IsEmpty() {
 		return errors.New("no scope available")
 	}
-	env.scopestack.BindSymbol(sym, expr, BIND_GLOBAL)
+	return env.scopestack.BindSymbol(sym, expr, BIND_GLOBAL)
+}
+
+// Freeze makes the global bindings and the macros named by names constant,
+// def, set!, defmac and OverrideFunction fail to change them afterwards with
+// an error wrapping ErrFrozen. Children of env cannot change them either.
+func (env *Environment) Freeze(names ...string) error {
+	if env.scopestack.IsEmpty() {
+		return errors.New("no scope available")
+	}
+	for _, name := range names {
+		sym := env.MakeSymbol(name)
+		_, isMacro := env.macros.Find(sym)
+		if isMacro {
+			env.macros.Freeze(sym)
+		}
+		if _, err := lookupFrom(env.scopestack.bottom, sym); err == nil {
+			if err := env.scopestack.freezeSymbol(sym); err != nil {
+				return err
+			}
+		} else if !isMacro {
+			return fmt.Errorf("`%s` not found", name)
+		}
+	}
+	return nil
+}
+
+// FreezeAll makes every global binding and macro defined so far constant,
+// see Freeze. Calling it once extensions are imported protects them and the
+// builtins from scripts.
+func (env *Environment) FreezeAll() error {
+	if err := env.scopestack.freezeGlobals(); err != nil {
+		return err
+	}
+	env.macros.freezeAll()
 	return nil
 }
 
@@ -240,6 +404,9 @@ func (env *Environment) ReturnFromFunction() error {
 	if err != nil {
 		return err
 	}
+	if env.profiler != nil {
+		env.profiler.leave(env.addrstack.Top())
+	}
 	scopestack, err := env.stackstack.Pop()
 	if err != nil {
 		return err
@@ -257,49 +424,59 @@ func (env *Environment) CallUserFunction(function *SexpFunction, name string, na
 	if err != nil {
 		return fmt.Errorf("Error calling %s: %v", name, err)
 	}
+	if err := env.checkCall(name, false); err != nil {
+		return err
+	}
 
-	env.addrstack.PushAddr(env.curfunc, min(env.pc+1, len(env.curfunc.fun)))
+	env.addrstack.PushCall(env.curfunc, min(env.pc+1, len(env.curfunc.fun)), nargs)
 	env.curfunc = function
 	env.pc = -1
+	if env.profiler != nil {
+		env.profiler.enter(function, name, env.addrstack.Top())
+	}
 
 	res, err := function.userfun(env, args)
 	if err != nil {
-		return fmt.Errorf("Error calling %s: %v", name, err)
+		return fmt.Errorf("Error calling %s: %w", name, err)
 	}
 
 	env.datastack.DropExpr(args.Len())
 	env.datastack.PushExpr(res)
 
 	env.curfunc, env.pc, _ = env.addrstack.PopAddr()
+	if env.profiler != nil {
+		env.profiler.leave(env.addrstack.Top())
+	}
 	return nil
 }
 
 func (env *Environment) ParseStream(in io.Reader) ([]Sexp, error) {
+	return env.parseNamedStream(in, "")
+}
+
+// parseNamedStream parses in, file is recorded in the source positions.
+func (env *Environment) parseNamedStream(in io.Reader, file string) ([]Sexp, error) {
 	lexer := NewLexerFromStream(bufio.NewReader(in))
+	lexer.SetFile(file)
 
 	var err error
 	var exp []Sexp
 
 	exp, err = ParseTokens(env, lexer)
 	if err != nil {
+		if file != "" {
+			return nil, fmt.Errorf("Error on line %d,%d in %s: %v\n", lexer.Linenum(), lexer.LineOffset(), file, err)
+		}
 		return nil, fmt.Errorf("Error on line %d,%d: %v\n", lexer.Linenum(), lexer.LineOffset(), err)
 	}
 
 	return exp, nil
 }
 
-// ParseFile, used in the generator at read time to dynamiclly add more defs from other files
+// ParseFile, used in the generator at read time to dynamiclly add more defs from other files,
+// file is looked up on the search path, see SetSearchPath
 func (env *Environment) ParseFile(file string) ([]Sexp, error) {
-	in, err := env.fileReader.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer in.Close()
-
-	var exp []Sexp
-
-	exp, err = env.ParseStream(in)
-
+	exp, _, err := env.parseFile(file)
 	return exp, err
 }
 
@@ -317,7 +494,7 @@ func (env *Environment) SourceExpressions(expressions []Sexp) error {
 	curfunc := env.curfunc
 	curpc := env.pc
 
-	env.curfunc = MakeFunction("__source", 0, false, gen.instructions)
+	env.curfunc = MakeFunction("__source", 0, false, gen.code())
 	env.pc = 0
 
 	env.datastack.PushExpr(SexpNull)
@@ -352,7 +529,7 @@ func (env *Environment) LoadExpressions(expressions []Sexp) error {
 		return err
 	}
 
-	env.mainfunc.fun = append(env.mainfunc.fun, gen.instructions...)
+	env.mainfunc.fun = append(env.mainfunc.fun, gen.code()...)
 	env.curfunc = env.mainfunc
 
 	return nil
@@ -378,6 +555,18 @@ func (env *Environment) EvalString(str string) (Sexp, error) {
 	return env.Run()
 }
 
+// EvalStringContext is like EvalString but stops once ctx is done, macros
+// are expanded with ctx too.
+func (env *Environment) EvalStringContext(ctx context.Context, str string) (Sexp, error) {
+	defer env.swapContext(ctx)()
+	err := env.LoadString(str)
+	if err != nil {
+		return SexpNull, err
+	}
+
+	return env.Run()
+}
+
 func (env *Environment) LoadFile(file *os.File) error {
 	return env.LoadStream(bufio.NewReader(file))
 }
@@ -394,6 +583,15 @@ func (env *Environment) AddNamedFunction(name string, function NamedUserFunction
 	env.BindGlobal(name, MakeUserFunction(name, function(name), opts...))
 }
 
+// AddInternalFunction registers f, a Go function a macro embeds in its
+// expansions. Scripts cannot call it by name, bytecode compiled from the
+// expansions finds it by its name when it is loaded.
+func (env *Environment) AddInternalFunction(f *SexpFunction) {
+	internals := copyFuncMap(env.internals)
+	internals[env.MakeSymbol(f.name).number] = f
+	env.internals = internals
+}
+
 func (env *Environment) AddMacro(name string, function UserFunction, opts ...FuntionOption) {
 	sym := env.MakeSymbol(name)
 	env.macros.Add(sym, MakeUserFunction(name, function, opts...))
@@ -452,12 +650,19 @@ func (env *Environment) ReachedEnd() bool {
 	return env.pc == env.CurrentFunctionSize()
 }
 
+// GetStackTrace renders the stack carried by err, or the current stack if
+// err is not a RuntimeError. It may be called any number of times.
 func (env *Environment) GetStackTrace(err error) string {
-	str := fmt.Sprintf("error in %s:%d: %v\n",
-		env.curfunc.name, env.pc, err)
-	for !env.addrstack.IsEmpty() {
-		fun, pos, _ := env.addrstack.PopAddr()
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+	var rtErr *RuntimeError
+	var frames []StackFrame
+	if errors.As(err, &rtErr) && len(rtErr.Stack) > 0 {
+		frames = rtErr.Stack
+	} else {
+		frames = env.Stack()
+	}
+	str := fmt.Sprintf("error in %s: %v\n", frames[0], err)
+	for _, frame := range frames[1:] {
+		str += fmt.Sprintf("in %s\n", frame)
 	}
 	return str
 }
@@ -466,6 +671,7 @@ func (env *Environment) Clear() {
 	env.datastack.tos = -1
 	env.scopestack.Clear()
 	env.addrstack.tos = -1
+	env.handlers = nil
 	env.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	env.curfunc = env.mainfunc
 	env.pc = 0
@@ -497,6 +703,18 @@ func (env *Environment) ApplyByName(fun string, args Args) (Sexp, error) {
 	return env.Apply(fn, args)
 }
 
+// ApplyByNameContext is like ApplyByName but stops once ctx is done.
+func (env *Environment) ApplyByNameContext(ctx context.Context, fun string, args Args) (Sexp, error) {
+	defer env.swapContext(ctx)()
+	return env.ApplyByName(fun, args)
+}
+
+// ApplyContext is like Apply but stops once ctx is done.
+func (env *Environment) ApplyContext(ctx context.Context, fun *SexpFunction, args Args) (Sexp, error) {
+	defer env.swapContext(ctx)()
+	return env.Apply(fun, args)
+}
+
 func (env *Environment) Apply(fun *SexpFunction, args Args) (Sexp, error) {
 	if fun.user {
 		return fun.userfun(env, args)
@@ -515,8 +733,111 @@ func (env *Environment) Apply(fun *SexpFunction, args Args) (Sexp, error) {
 	return env.Run()
 }
 
+// Context returns the context of the current evaluation, builtins doing
+// blocking work should give up once it is done.
+func (env *Environment) Context() context.Context {
+	if env.ctx == nil {
+		return context.Background()
+	}
+	return env.ctx
+}
+
+// hostValue is a value attached by SetValue. The list is never changed, so
+// environments duplicated for coroutines and macros share it safely.
+type hostValue struct {
+	key, value any
+	next       *hostValue
+}
+
+// SetValue attaches a host value to env for Go functions called by its
+// scripts to read with Value, key must be comparable as for
+// context.WithValue. Environments created afterwards by Duplicate,
+// Clone and NewChild carry it, values for a single evaluation are better
+// put in the context passed to EvalStringContext or ApplyContext.
+func (env *Environment) SetValue(key, value any) {
+	env.values = &hostValue{key: key, value: value, next: env.values}
+}
+
+// Value returns the host value attached to env for key by SetValue, or else
+// the value of the context of the current evaluation for key.
+func (env *Environment) Value(key any) any {
+	for v := env.values; v != nil; v = v.next {
+		if v.key == key {
+			return v.value
+		}
+	}
+	return env.Context().Value(key)
+}
+
+// RunContext is like Run but stops with an error wrapping ctx.Err() once
+// ctx is done.
+func (env *Environment) RunContext(ctx context.Context) (Sexp, error) {
+	defer env.swapContext(ctx)()
+	return env.Run()
+}
+
+func (env *Environment) swapContext(ctx context.Context) func() {
+	old := env.ctx
+	env.ctx = ctx
+	return func() { env.ctx = old }
+}
+
+// checkpoint is called by Run every CheckpointInterval instructions, or
+// earlier when the instruction budget is about to run out, and before every
+// instruction while a debugger is attached.
+func (env *Environment) checkpoint() error {
+	left, err := env.flushTicks()
+	if err != nil {
+		return err
+	}
+	if left > CheckpointInterval {
+		left = CheckpointInterval
+	}
+	env.nextCheckpoint = env.ticks + left
+	if env.ctx != nil {
+		if err := env.ctx.Err(); err != nil {
+			return fmt.Errorf("evaluation cancelled: %w", err)
+		}
+	}
+	if env.debugger != nil {
+		// check again before the next instruction
+		env.nextCheckpoint = env.ticks
+		return env.debugger.check(env)
+	}
+	return nil
+}
+
 func (env *Environment) Run() (Sexp, error) {
+	// always checkpoint on the first instruction, the shared budget may have
+	// been used up by a coroutine in the meantime
+	env.nextCheckpoint = env.ticks
+	env.depth++
+	base := env.addrstack.Top()
+	ret, err := env.run()
+	for err != nil && env.catch(err) {
+		ret, err = env.run()
+	}
+	if err != nil {
+		env.dropHandlers(env.depth)
+		err = env.newRuntimeError(err)
+		if env.profiler != nil {
+			// the calls of this run end with the error, including the
+			// function started by Apply
+			env.profiler.leave(base - 1)
+		}
+	}
+	env.depth--
+	env.flushTicks()
+	return ret, err
+}
+
+func (env *Environment) run() (Sexp, error) {
 	for env.pc != -1 && !env.ReachedEnd() {
+		if env.ticks++; env.ticks > env.nextCheckpoint {
+			if err := env.checkpoint(); err != nil {
+				return SexpNull, err
+			}
+		}
 		instr := env.curfunc.fun[env.pc]
 		switch instr.Op {
 		case OpPush:
@@ -555,13 +876,46 @@ func (env *Environment) Run() (Sexp, error) {
 			env.pc++
 			if instr.IsSet {
 				if err := env.scopestack.SetSymbol(instr.Sym, expr); err != nil {
-					return SexpNull, err
+					return SexpNull, errorAt(instr, err)
 				}
 			} else {
 				if err := env.scopestack.BindSymbol(instr.Sym, expr); err != nil {
-					return SexpNull, err
+					return SexpNull, errorAt(instr, err)
 				}
 			}
+		case OpPutConst:
+			expr, err := env.datastack.PopExpr()
+			if err != nil {
+				return SexpNull, err
+			}
+			env.pc++
+			if err := env.scopestack.BindSymbol(instr.Sym, expr, BIND_GLOBAL); err != nil {
+				return SexpNull, errorAt(instr, err)
+			}
+			if err := env.scopestack.freezeSymbol(instr.Sym); err != nil {
+				return SexpNull, errorAt(instr, err)
+			}
+		case OpGetLocal:
+			expr, err := env.scopestack.LookupLocal(instr.Sym, instr.Depth, instr.Slot)
+			if err != nil {
+				return SexpNull, err
+			}
+			env.datastack.PushExpr(expr)
+			env.pc++
+		case OpPutLocal:
+			expr, err := env.datastack.PopExpr()
+			if err != nil {
+				return SexpNull, err
+			}
+			env.pc++
+			if instr.IsSet {
+				err = env.scopestack.SetLocal(instr.Sym, instr.Depth, instr.Slot, expr)
+			} else {
+				err = env.scopestack.BindLocal(instr.Slot, expr)
+			}
+			if err != nil {
+				return SexpNull, err
+			}
 		case OpBindDynFun:
 			expr, err := env.datastack.PopExpr()
 			if err != nil {
@@ -624,11 +978,11 @@ func (env *Environment) Run() (Sexp, error) {
 				return SexpNull, err
 			}
 		case OpCall:
-			if err := env.callInstruction(instr.Sym, instr.Nargs); err != nil {
+			if err := env.callInstruction(instr.Sym, instr.Nargs, instr.Cache); err != nil {
 				return SexpNull, err
 			}
 		case OpPrepare:
-			if err := env.execPrepareInstr(instr.Sym, instr.Nargs); err != nil {
+			if err := env.execPrepareInstr(instr.Sym, instr.Nargs, instr.Cache); err != nil {
 				return SexpNull, err
 			}
 			env.pc++
@@ -636,8 +990,43 @@ func (env *Environment) Run() (Sexp, error) {
 			if err := env.dispatchInstruction(instr.Nargs); err != nil {
 				return SexpNull, err
 			}
+		case OpTailCall:
+			if err := env.tailCallInstruction(instr.Sym, instr.Nargs, instr.Cache); err != nil {
+				return SexpNull, err
+			}
+		case OpTailDispatch:
+			if err := env.tailDispatchInstruction(instr.Nargs); err != nil {
+				return SexpNull, err
+			}
+		case OpTry:
+			env.pushHandler(env.pc + instr.Loc)
+			env.pc++
+		case OpEndTry:
+			if err := env.popHandler(); err != nil {
+				return SexpNull, err
+			}
+			env.pc++
+		case OpThrow:
+			expr, err := env.datastack.PopExpr()
+			if err != nil {
+				return SexpNull, err
+			}
+			return SexpNull, throwValue(expr)
+		case OpRequire:
+			if !env.moduleLoaded(instr.Sym) {
+				env.pc++
+				break
+			}
+			newpc := env.pc + instr.Loc
+			if newpc < 0 || newpc > env.CurrentFunctionSize() {
+				return SexpNull, OutOfBounds
+			}
+			env.pc = newpc
 		case OpAddScope:
-			env.scopestack.PushScope()
+			if err := env.checkScope(env.curfunc.name, env.scopestack.Depth()+1); err != nil {
+				return SexpNull, err
+			}
+			env.scopestack.PushFrame(instr.Frame)
 			env.pc++
 		case OpRemoveScope:
 			env.pc++
@@ -699,6 +1088,36 @@ func (env *Environment) Run() (Sexp, error) {
 				env.datastack.PushExpr(SexpNull)
 			}
 			env.pc++
+		case OpUnpackNth, OpUnpackRest:
+			expr, err := env.datastack.PopExpr()
+			if err != nil {
+				return SexpNull, err
+			}
+			res, err := unpackNth(expr, instr.Nargs, instr.Op == OpUnpackRest)
+			if err != nil {
+				return SexpNull, err
+			}
+			env.datastack.PushExpr(res)
+			env.pc++
+		case OpUnpackKey:
+			expr, err := env.datastack.PopExpr()
+			if err != nil {
+				return SexpNull, err
+			}
+			res, found, err := env.unpackKey(expr, instr.Expr)
+			if err != nil {
+				return SexpNull, err
+			}
+			if !found {
+				env.pc++
+				break
+			}
+			newpc := env.pc + instr.Loc
+			if newpc < 0 || newpc > env.CurrentFunctionSize() {
+				return SexpNull, OutOfBounds
+			}
+			env.datastack.PushExpr(res)
+			env.pc = newpc
 		case OpLt:
 			cond, err := env.doCompare("<", instr.Nargs)
 			if err != nil {
@@ -897,6 +1316,9 @@ func (env *Environment) Run() (Sexp, error) {
 			default:
 				return SexpNull, errors.New("First argument of append must be array or string but got " + InspectType(args.Get(0)))
 			}
+			if err = env.CheckAllocOf(res); err != nil {
+				return SexpNull, err
+			}
 			env.datastack.DropExpr(args.Len())
 			env.datastack.PushExpr(res)
 			env.pc++
@@ -909,6 +1331,9 @@ func (env *Environment) Run() (Sexp, error) {
 			if err != nil {
 				return SexpNull, err
 			}
+			if err = env.CheckAllocOf(res); err != nil {
+				return SexpNull, err
+			}
 			env.datastack.DropExpr(args.Len())
 			env.datastack.PushExpr(res)
 			env.pc++
@@ -917,6 +1342,9 @@ func (env *Environment) Run() (Sexp, error) {
 			if err != nil {
 				return SexpNull, err
 			}
+			if err = env.CheckAlloc(AllocArray, args.Len()); err != nil {
+				return SexpNull, err
+			}
 			res := MakeListByArgs(args)
 			env.datastack.DropExpr(args.Len())
 			env.datastack.PushExpr(res)
@@ -926,6 +1354,9 @@ func (env *Environment) Run() (Sexp, error) {
 			if err != nil {
 				return SexpNull, err
 			}
+			if err = env.CheckAlloc(AllocArray, args.Len()); err != nil {
+				return SexpNull, err
+			}
 			res := SexpArray(args.GetAll())
 			env.datastack.DropExpr(args.Len())
 			env.datastack.PushExpr(res)
@@ -939,6 +1370,9 @@ func (env *Environment) Run() (Sexp, error) {
 			if err := sexpToString(&sb, args); err != nil {
 				return SexpNull, err
 			}
+			if err = env.CheckAlloc(AllocString, sb.Len()); err != nil {
+				return SexpNull, err
+			}
 			env.datastack.DropExpr(args.Len())
 			env.datastack.PushExpr(SexpStr(sb.String()))
 			env.pc++
@@ -996,13 +1430,9 @@ func (env *Environment) bindListInstruction() error {
 	return err
 }
 
-func (env *Environment) callInstruction(sym SexpSymbol, nargs int) error {
-	funcobj, err := env.scopestack.LookupSymbol(sym)
+func (env *Environment) callInstruction(sym SexpSymbol, nargs int, cache *callCache) error {
+	funcobj, err := env.lookupCallee(sym, cache)
 	if err != nil {
-		f, ok := env.builtins[sym.number]
-		if ok {
-			return env.CallUserFunction(f, sym.name, nargs)
-		}
 		return err
 	}
 	switch f := funcobj.(type) {
@@ -1031,17 +1461,63 @@ func (env *Environment) dispatchInstruction(nargs int) error {
 	return fmt.Errorf("%s not a function", funcobj.SexpString())
 }
 
-func (env *Environment) execPrepareInstr(sym SexpSymbol, nargs int) error {
-	funcobj, err := env.scopestack.LookupSymbol(sym)
+// tailCallInstruction calls the function sym resolves to in place of the
+// running one.
+func (env *Environment) tailCallInstruction(sym SexpSymbol, nargs int, cache *callCache) error {
+	funcobj, err := env.lookupCallee(sym, cache)
+	if err != nil {
+		return err
+	}
+	f, ok := funcobj.(*SexpFunction)
+	if !ok {
+		return fmt.Errorf("%s is not a function", sym.name)
+	}
+	return env.tailCall(f, sym.name, nargs)
+}
+
+func (env *Environment) tailDispatchInstruction(nargs int) error {
+	funcobj, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	f, ok := funcobj.(*SexpFunction)
+	if !ok {
+		return fmt.Errorf("%s not a function", funcobj.SexpString())
+	}
+	return env.tailCall(f, f.name, nargs)
+}
+
+// tailCall calls function from the tail position of the running function.
+// A function compiled to bytecode takes the place of the running one, which
+// returns first so the call stack does not grow, Go functions are called
+// as usual.
+func (env *Environment) tailCall(function *SexpFunction, name string, nargs int) error {
+	if function.user {
+		return env.CallUserFunction(function, name, nargs)
+	}
+	body, err := env.prepareCall(function, nargs)
+	if err != nil {
+		return err
+	}
+	// the arguments stay on the data stack
+	if err := env.ReturnFromFunction(); err != nil {
+		return err
+	}
+	return env.enterFunction(function, body, nargs, env.pc)
+}
+
+func (env *Environment) execPrepareInstr(sym SexpSymbol, nargs int, cache *callCache) error {
+	funcobj, err := env.lookupCallee(sym, cache)
 	if err != nil {
-		_, ok := env.builtins[sym.number]
-		if ok {
-			return nil
-		}
 		return err
 	}
 	switch f := funcobj.(type) {
 	case *SexpFunction:
+		if f.arities != nil {
+			if f, err = f.arity(nargs); err != nil {
+				return err
+			}
+		}
 		if !f.user && f.varargs {
 			return env.wrangleOptargs(f.nargs, nargs)
 		}
@@ -1056,10 +1532,13 @@ func (env *Environment) GlobalFunctions() []string {
 	ret = append(ret,
 		"and", "or", "cond",
 		"quote",
-		"def", "fn", "defn", "set!",
+		"def", "defconst", "fn", "defn", "set!",
+		"def-", "defn-", "ns", "require",
 		"begin",
 		"let", "let*",
+		"loop", "recur",
 		"assert",
+		"try",
 		"defmac",
 		"macexpand",
 		"syntax-quote",
@@ -1089,22 +1568,7 @@ func (env *Environment) OverrideFunction(name string, f OverrideFunction, opts .
 	fn := obj.(*SexpFunction).Clone()
 	fn.name = name
 	nopts := []FuntionOption{WithDoc(fn.Doc())}
-	env.AddFunction(name, f(fn), append(nopts, opts...)...)
-	return nil
-}
-
-type nextSymbol struct{ counter int64 }
-
-func (g *nextSymbol) Incr() int64 {
-	return atomic.AddInt64(&g.counter, 1)
-}
-
-func (g *nextSymbol) Get() int64 {
-	return atomic.LoadInt64(&g.counter)
-}
-
-func (g *nextSymbol) Clone() *nextSymbol {
-	return &nextSymbol{counter: g.counter}
+	return env.BindGlobal(name, MakeUserFunction(name, f(fn), append(nopts, opts...)...))
 }
 
 func (env *Environment) doCompare(name string, nargs int) (bool, error) {
@@ -1177,6 +1641,11 @@ func (env *Environment) doHashAccess(name string, nargs int) (Sexp, error) {
 	if err != nil {
 		return SexpNull, err
 	}
+	if name == "hset!" {
+		if err = env.checkHashSet(args); err != nil {
+			return SexpNull, err
+		}
+	}
 	return hashAccess(name, args)
 }
 func (env *Environment) doMakeHash(nargs int) (Sexp, error) {
@@ -1185,5 +1654,8 @@ func (env *Environment) doMakeHash(nargs int) (Sexp, error) {
 	if err != nil {
 		return SexpNull, err
 	}
+	if err = env.CheckAlloc(AllocHash, args.Len()/2); err != nil {
+		return SexpNull, err
+	}
 	return MakeHash(args)
 }
@@ -23,6 +23,9 @@ func Base64StringToBytes(name string) glisp.UserFunction {
 		if !ok {
 			return glisp.SexpNull, fmt.Errorf(`%s argument should be string but got %v`, name, glisp.InspectType(args.Get(0)))
 		}
+		if err := env.CheckAlloc(glisp.AllocBytes, base64.StdEncoding.DecodedLen(len(str))); err != nil {
+			return glisp.SexpNull, err
+		}
 		bytes, err := base64.StdEncoding.DecodeString(string(str))
 		if err != nil {
 			return glisp.SexpNull, err
@@ -55,11 +55,20 @@ func ChanTxFunction(name string) glisp.UserFunction {
 			if args.Len() != 2 {
 				return glisp.WrongNumberArguments(name, args.Len(), 2)
 			}
-			channel <- args.Get(1)
-			return glisp.SexpNull, nil
+			select {
+			case channel <- args.Get(1):
+				return glisp.SexpNull, nil
+			case <-env.Context().Done():
+				return glisp.SexpNull, env.Context().Err()
+			}
 		}
 
-		return <-channel, nil
+		select {
+		case expr := <-channel:
+			return expr, nil
+		case <-env.Context().Done():
+			return glisp.SexpNull, env.Context().Err()
+		}
 	}
 }
 
@@ -19,6 +19,9 @@ func ImportCoreUtils(vm *glisp.Environment) error {
 	env.AddNamedMacro("doc", GetDocFunction)
 	env.AddNamedMacro("defined?", SymbolDefinedFunction)
 	env.AddFuzzyMacro(`^:[^:]+$`, ExplainColonMacro)
+	vm.AddInternalFunction(docSexpFunction)
+	vm.AddInternalFunction(definedSexpFunction)
+	vm.AddInternalFunction(explainSexpFunction)
 	env.AddNamedFunction("sort", GetSortFunction)
 	env.AddNamedFunction("compose", GetComposeFunction)
 	/* stream */
@@ -203,23 +206,31 @@ func transformFmt(fmtstr string, args glisp.Args) (string, []any) {
 	return "", ret
 }
 
-func GetDocFunction(name string) glisp.UserFunction {
-	userfn := func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
-		name := args.Get(0).(glisp.SexpSymbol).Name()
-		var doc string
-		if expr, ok := env.FindObject(name); ok && glisp.IsFunction(expr) {
-			doc = expr.(*glisp.SexpFunction).Doc()
-		} else if mac, ok := env.FindMacro(name); ok {
-			doc = mac.Doc()
-		} else {
-			doc = glisp.QueryBuiltinDoc(name)
-		}
-		if doc == `` {
-			doc = `No document found.`
-		}
-		return glisp.SexpStr(doc), nil
+// The Go functions embedded in the expansions of the macros below are
+// registered as internal functions, so compiled bytecode can refer to them.
+var (
+	docSexpFunction     = glisp.MakeUserFunction("__doc", docFunction)
+	definedSexpFunction = glisp.MakeUserFunction("__defined?", definedFunction)
+	explainSexpFunction = glisp.MakeUserFunction("__explain", explainFunction)
+)
+
+func docFunction(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+	name := args.Get(0).(glisp.SexpSymbol).Name()
+	var doc string
+	if expr, ok := env.FindObject(name); ok && glisp.IsFunction(expr) {
+		doc = expr.(*glisp.SexpFunction).Doc()
+	} else if mac, ok := env.FindMacro(name); ok {
+		doc = mac.Doc()
+	} else {
+		doc = glisp.QueryBuiltinDoc(name)
 	}
-	sexpfn := glisp.MakeUserFunction(name, userfn)
+	if doc == `` {
+		doc = `No document found.`
+	}
+	return glisp.SexpStr(doc), nil
+}
+
+func GetDocFunction(name string) glisp.UserFunction {
 	return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
 		if args.Len() != 1 {
 			return glisp.WrongNumberArguments(name, args.Len(), 1)
@@ -230,7 +241,7 @@ func GetDocFunction(name string) glisp.UserFunction {
 		return glisp.MakeList([]glisp.Sexp{
 			env.MakeSymbol("println"),
 			glisp.MakeList([]glisp.Sexp{
-				sexpfn,
+				docSexpFunction,
 				glisp.MakeList([]glisp.Sexp{
 					env.MakeSymbol("quote"),
 					args.Get(0).(glisp.SexpSymbol),
@@ -240,33 +251,33 @@ func GetDocFunction(name string) glisp.UserFunction {
 	}
 }
 
-func SymbolDefinedFunction(name string) glisp.UserFunction {
-	userfn := func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
-		var name string
-		switch args.Get(0).(type) {
-		case *glisp.SexpFunction:
-			return glisp.SexpBool(true), nil
-		case glisp.SexpSymbol:
-			name = args.Get(0).(glisp.SexpSymbol).Name()
-		case glisp.SexpStr:
-			name = string(args.Get(0).(glisp.SexpStr))
-		default:
-			return glisp.SexpNull, fmt.Errorf("can't guess %v definition", glisp.InspectType(args.Get(0)))
-		}
-		if _, ok := env.FindObject(name); ok {
-			return glisp.SexpBool(true), nil
-		} else if _, ok = env.FindMacro(name); ok {
-			return glisp.SexpBool(true), nil
-		} else {
-			return glisp.SexpBool(false), nil
-		}
+func definedFunction(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+	var name string
+	switch args.Get(0).(type) {
+	case *glisp.SexpFunction:
+		return glisp.SexpBool(true), nil
+	case glisp.SexpSymbol:
+		name = args.Get(0).(glisp.SexpSymbol).Name()
+	case glisp.SexpStr:
+		name = string(args.Get(0).(glisp.SexpStr))
+	default:
+		return glisp.SexpNull, fmt.Errorf("can't guess %v definition", glisp.InspectType(args.Get(0)))
 	}
-	sexpfn := glisp.MakeUserFunction(name, userfn)
+	if _, ok := env.FindObject(name); ok {
+		return glisp.SexpBool(true), nil
+	} else if _, ok = env.FindMacro(name); ok {
+		return glisp.SexpBool(true), nil
+	} else {
+		return glisp.SexpBool(false), nil
+	}
+}
+
+func SymbolDefinedFunction(name string) glisp.UserFunction {
 	return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
 		if args.Len() != 1 {
 			return glisp.WrongNumberArguments(name, args.Len(), 1)
 		}
-		newArgs := append([]glisp.Sexp{sexpfn}, args.GetAll()...)
+		newArgs := append([]glisp.Sexp{definedSexpFunction}, args.GetAll()...)
 		return glisp.MakeList(newArgs), nil
 	}
 }
@@ -275,17 +286,18 @@ type ExplainSexp interface {
 	Explain(*glisp.Environment, string, glisp.Args) (glisp.Sexp, error)
 }
 
+func explainFunction(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+	if ex, ok := args.Get(1).(ExplainSexp); ok {
+		return ex.Explain(env, string(args.Get(0).(glisp.SexpStr)), args.SliceStart(2))
+	}
+	/* nil explain anything as nil */
+	if args.Get(1) == glisp.SexpNull {
+		return glisp.SexpNull, nil
+	}
+	return glisp.SexpNull, fmt.Errorf("type `%s` can't explain `%s`", glisp.InspectType(args.Get(1)), args.Get(0).SexpString())
+}
+
 func ExplainColonMacro(name string) glisp.UserFunction {
-	sexpfn := glisp.MakeUserFunction(name, func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
-		if ex, ok := args.Get(1).(ExplainSexp); ok {
-			return ex.Explain(env, string(args.Get(0).(glisp.SexpStr)), args.SliceStart(2))
-		}
-		/* nil explain anything as nil */
-		if args.Get(1) == glisp.SexpNull {
-			return glisp.SexpNull, nil
-		}
-		return glisp.SexpNull, fmt.Errorf("type `%s` can't explain `%s`", glisp.InspectType(args.Get(1)), args.Get(0).SexpString())
-	})
 	return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
 		if args.Len() < 2 {
 			return glisp.WrongNumberArguments(name, args.Len(), 2, glisp.Many)
@@ -294,7 +306,7 @@ func ExplainColonMacro(name string) glisp.UserFunction {
 			return glisp.SexpNull, fmt.Errorf("%s first argument must be string but got %s", name, glisp.InspectType(args.Get(0)))
 		}
 		colon := string(args.Get(0).(glisp.SexpStr))
-		vargs := []glisp.Sexp{sexpfn, glisp.SexpStr(colon[1:])}
+		vargs := []glisp.Sexp{explainSexpFunction, glisp.SexpStr(colon[1:])}
 		vargs = append(vargs, args.GetAll()[1:]...)
 		return glisp.MakeList(vargs), nil
 	}
@@ -20,7 +20,7 @@ func (coro SexpCoroutine) TypeName() string {
 func StartCoroutineFunction(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
 	switch t := args.Get(0).(type) {
 	case SexpCoroutine:
-		go t.env.Run()
+		go t.env.RunContext(env.Context())
 	default:
 		return glisp.SexpNull, errors.New("not a coroutine")
 	}
@@ -461,7 +461,7 @@ func evalSingleHTTP(name string, hreq request, urlstr string, env *glisp.Environ
 		}
 	}
 	/* build http request */
-	req, err := http.NewRequest(method, urlstr, hreq.Data)
+	req, err := http.NewRequestWithContext(env.Context(), method, urlstr, hreq.Data)
 	if err != nil {
 		return glisp.SexpNull, fmt.Errorf("%s build request fail %v", name, err)
 	}
@@ -523,6 +523,9 @@ func evalSingleHTTP(name string, hreq request, urlstr string, env *glisp.Environ
 		if err != nil {
 			return glisp.SexpNull, err
 		}
+		if err = env.CheckAlloc(glisp.AllocBytes, len(bs)); err != nil {
+			return glisp.SexpNull, err
+		}
 	}
 
 	var responseBody glisp.Sexp = glisp.NewSexpBytes(bs)
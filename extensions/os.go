@@ -60,7 +60,7 @@ func ExecCommand(opts *CommandOptions) glisp.NamedUserFunction {
 			if cmdstr == "" {
 				return glisp.SexpNull, errors.New("no cmd found")
 			}
-			cmd := exec.Command("bash", "-c", cmdstr)
+			cmd := exec.CommandContext(env.Context(), "bash", "-c", cmdstr)
 			/* workding directory */
 			if cwd := getHashStr(hash, "cwd"); cwd != "" {
 				cmd.Dir = replaceHomeDirSymbol(cwd)
@@ -117,10 +117,19 @@ func GetReadFile(name string) glisp.UserFunction {
 			return glisp.SexpNull, fmt.Errorf(`%s argument should be string but got %v`, name, glisp.InspectType(args.Get(0)))
 		}
 		filename := replaceHomeDirSymbol(string(str))
+		if info, err := os.Stat(filename); err == nil {
+			if err := env.CheckAlloc(glisp.AllocBytes, int(info.Size())); err != nil {
+				return glisp.SexpNull, err
+			}
+		}
 		data, err := os.ReadFile(filename)
 		if err != nil {
 			return glisp.SexpNull, err
 		}
+		// the file may have grown since it was checked
+		if err := env.CheckAlloc(glisp.AllocBytes, len(data)); err != nil {
+			return glisp.SexpNull, err
+		}
 		return glisp.NewSexpBytes(data), nil
 	}
 }
@@ -318,7 +327,7 @@ func RunCommand(name string) glisp.UserFunction {
 		if !glisp.IsString(args.Get(0)) {
 			return glisp.SexpNull, errors.New("cmd must be string but got " + glisp.InspectType(args.Get(0)))
 		}
-		cmd := exec.Command("bash", "-c", string(args.Get(0).(glisp.SexpStr)))
+		cmd := exec.CommandContext(env.Context(), "bash", "-c", string(args.Get(0).(glisp.SexpStr)))
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -189,6 +189,12 @@ func (t *sexpRecord) GetTag(name string) glisp.SexpStr {
 	return glisp.SexpStr(t.class.fieldsMeta[name].Tag)
 }
 
+// HasField reports whether the record has a field called name.
+func (t *sexpRecord) HasField(name string) bool {
+	_, ok := t.class.fieldsMeta[name]
+	return ok
+}
+
 func (t *sexpRecord) GetField(name string) (glisp.Sexp, error) {
 	if _, ok := t.class.fieldsMeta[name]; !ok {
 		return glisp.SexpNull, fmt.Errorf("record<%s> not have a field named %s", t.TypeName(), name)
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"crypto/sha256"
 	"fmt"
+	"math"
 	"strings"
 	"unicode/utf8"
 
@@ -225,7 +226,15 @@ func StringRepeat(name string) glisp.UserFunction {
 		if !glisp.IsInt(args.Get(1)) {
 			return glisp.SexpNull, fmt.Errorf(`%s second argument should be int but got %v`, name, glisp.InspectType(args.Get(1)))
 		}
-		return glisp.SexpStr(strings.Repeat(toStr(args.Get(0)), args.Get(1).(glisp.SexpInt).ToInt())), nil
+		str, count := toStr(args.Get(0)), args.Get(1).(glisp.SexpInt).ToInt()
+		size := len(str) * count
+		if count > 0 && len(str) > math.MaxInt/count {
+			size = math.MaxInt
+		}
+		if err := env.CheckAlloc(glisp.AllocString, size); err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.SexpStr(strings.Repeat(str, count)), nil
 	}
 }
 
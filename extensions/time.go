@@ -3,6 +3,7 @@ package extensions
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/qjpcpu/glisp"
@@ -24,6 +25,12 @@ func ImportTime(vm *glisp.Environment) error {
 	env.AddNamedFunction("time/minute", TimeMinuteOf)
 	env.AddNamedFunction("time/second", TimeSecondOf)
 	env.AddNamedFunction("time/weekday", TimeWeekdayOf)
+	vm.RegisterGoConverter(reflect.TypeOf(time.Time{}), func(v any) glisp.Sexp {
+		return SexpTime(v.(time.Time))
+	}, func(expr glisp.Sexp) (any, bool) {
+		tm, ok := expr.(SexpTime)
+		return time.Time(tm), ok
+	})
 	mustLoadScript(env.Environment, "time")
 	return nil
 }
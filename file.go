@@ -1,8 +1,15 @@
 package glisp
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 )
 
 type FileReader interface {
@@ -16,3 +23,157 @@ type osFileReader struct{}
 func (osFileReader) Open(file string) (io.ReadCloser, error) {
 	return os.Open(file)
 }
+
+// DirFileReader reads the files under dir, paths leading out of it such
+// as ../file are not found.
+func DirFileReader(dir string) FileReader { return dirFileReader(dir) }
+
+type dirFileReader string
+
+func (d dirFileReader) Open(file string) (io.ReadCloser, error) {
+	name, err := validPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.DirFS(string(d)).Open(name)
+}
+
+func (d dirFileReader) location(file string) string {
+	return filepath.Join(string(d), file)
+}
+
+// FSFileReader reads the files of fsys, such as an embed.FS, by their path
+// from its root. name tells its files apart, they are reported as
+// name:path in errors and by Modules.
+func FSFileReader(name string, fsys fs.FS) FileReader {
+	return &fsFileReader{name: name, fsys: fsys}
+}
+
+type fsFileReader struct {
+	name string
+	fsys fs.FS
+}
+
+func (r *fsFileReader) Open(file string) (io.ReadCloser, error) {
+	name, err := validPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return r.fsys.Open(name)
+}
+
+// validPath returns file as a path of an fs.FS, a path leaving its root is
+// not found.
+func validPath(file string) (string, error) {
+	name := path.Clean(filepath.ToSlash(file))
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: file, Err: fs.ErrNotExist}
+	}
+	return name, nil
+}
+
+func (r *fsFileReader) location(file string) string {
+	return r.name + ":" + path.Clean(filepath.ToSlash(file))
+}
+
+// locator is a FileReader telling where it finds a file, for the others
+// the file is its own location.
+type locator interface {
+	location(file string) string
+}
+
+func location(fr FileReader, file string) string {
+	if l, ok := fr.(locator); ok {
+		return l.location(file)
+	}
+	return file
+}
+
+func sameReader(a, b FileReader) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// Module is a file loaded by include, require or source-file.
+type Module struct {
+	// Name is the path given by the script, Path is where it was found
+	Name string
+	Path string
+}
+
+// sourceFile is a file found by a FileReader.
+type sourceFile struct {
+	reader FileReader
+	file   string
+}
+
+// SetSearchPath sets the roots include, require and source-file look for
+// a file in. A file is looked up relative to the file loading it first,
+// then as it is with the FileReader of the environment, then in roots in
+// order.
+func (env *Environment) SetSearchPath(roots ...FileReader) {
+	env.searchPath = append([]FileReader(nil), roots...)
+}
+
+// Modules returns the files loaded so far, each once in the order they
+// were first found.
+func (env *Environment) Modules() []Module {
+	return env.namespaces.modulesFound()
+}
+
+// openFile finds file on the search path, the error of a missing file
+// lists every location tried.
+func (env *Environment) openFile(file string) (io.ReadCloser, sourceFile, error) {
+	var candidates []sourceFile
+	if env.loading != nil && !filepath.IsAbs(file) {
+		dir := filepath.Dir(env.loading.file)
+		candidates = append(candidates, sourceFile{reader: env.loading.reader, file: filepath.Join(dir, file)})
+	}
+	candidates = append(candidates, sourceFile{reader: env.fileReader, file: file})
+	if !filepath.IsAbs(file) {
+		for _, root := range env.searchPath {
+			candidates = append(candidates, sourceFile{reader: root, file: file})
+		}
+	}
+
+	var tried []string
+	var notFound error
+	for i, c := range candidates {
+		if i > 0 && filepath.Clean(c.file) == filepath.Clean(candidates[0].file) && sameReader(c.reader, candidates[0].reader) {
+			continue
+		}
+		loc := location(c.reader, c.file)
+		tried = append(tried, loc)
+		in, err := c.reader.Open(c.file)
+		if err == nil {
+			env.namespaces.addModule(Module{Name: file, Path: loc})
+			return in, c, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, c, err
+		}
+		if notFound == nil {
+			notFound = err
+		}
+	}
+	return nil, sourceFile{}, fmt.Errorf("cannot find %s, tried %s: %w", file, strings.Join(tried, ", "), notFound)
+}
+
+// parseFile parses the file found for file on the search path.
+func (env *Environment) parseFile(file string) ([]Sexp, sourceFile, error) {
+	in, src, err := env.openFile(file)
+	if err != nil {
+		return nil, src, err
+	}
+	defer in.Close()
+	exps, err := env.parseNamedStream(in, location(src.reader, src.file))
+	return exps, src, err
+}
+
+// loadingFile makes src the file being loaded until the function it
+// returns is called, the files it loads are looked up next to it.
+func (env *Environment) loadingFile(src sourceFile) func() {
+	loading := env.loading
+	env.loading = &src
+	return func() { env.loading = loading }
+}
@@ -3,6 +3,11 @@ package glisp
 type FuncMap struct {
 	funcs map[int]*SexpFunction
 	fuzzy []*SexpFunction
+	// parent holds the functions of a parent environment, found when
+	// neither funcs nor fuzzy match and never changed through the map.
+	parent *FuncMap
+	// consts holds the symbols of the frozen functions
+	consts map[int]bool
 }
 
 func NewFuncMap() *FuncMap {
@@ -23,9 +28,20 @@ func (fm *FuncMap) Add(sym SexpSymbol, f *SexpFunction) {
 	fm.fuzzy = append(fm.fuzzy, f)
 }
 
+// Child returns an empty map falling back to fm.
+func (fm *FuncMap) Child() *FuncMap {
+	return &FuncMap{funcs: make(map[int]*SexpFunction), parent: fm}
+}
+
 func (fm *FuncMap) Names() (ret []string) {
-	for _, f := range fm.funcs {
-		ret = append(ret, f.name)
+	seen := make(map[int]bool)
+	for m := fm; m != nil; m = m.parent {
+		for k, f := range m.funcs {
+			if !seen[k] {
+				seen[k] = true
+				ret = append(ret, f.name)
+			}
+		}
 	}
 	return
 }
@@ -39,9 +55,43 @@ func (fm *FuncMap) Find(sym SexpSymbol) (*SexpFunction, bool) {
 			return f, true
 		}
 	}
+	if fm.parent != nil {
+		return fm.parent.Find(sym)
+	}
 	return nil, false
 }
 
+// Freeze marks the function of sym as constant, see IsFrozen.
+func (fm *FuncMap) Freeze(sym SexpSymbol) {
+	if fm.consts == nil {
+		fm.consts = make(map[int]bool)
+	}
+	fm.consts[sym.number] = true
+}
+
+// freezeAll marks every function of the map and its parents as constant.
+func (fm *FuncMap) freezeAll() {
+	if fm.consts == nil {
+		fm.consts = make(map[int]bool)
+	}
+	for m := fm; m != nil; m = m.parent {
+		for k := range m.funcs {
+			fm.consts[k] = true
+		}
+	}
+}
+
+// IsFrozen reports whether the function of sym is constant, in which case
+// it must not be replaced.
+func (fm *FuncMap) IsFrozen(sym SexpSymbol) bool {
+	for m := fm; m != nil; m = m.parent {
+		if m.consts[sym.number] {
+			return true
+		}
+	}
+	return false
+}
+
 func (fm *FuncMap) Clone() *FuncMap {
 	funcs := make(map[int]*SexpFunction)
 	for k, v := range fm.funcs {
@@ -49,5 +99,12 @@ func (fm *FuncMap) Clone() *FuncMap {
 	}
 	fuzzy := make([]*SexpFunction, len(fm.fuzzy))
 	copy(fuzzy, fm.fuzzy)
-	return &FuncMap{funcs: funcs, fuzzy: fuzzy}
+	var consts map[int]bool
+	if fm.consts != nil {
+		consts = make(map[int]bool, len(fm.consts))
+		for k := range fm.consts {
+			consts[k] = true
+		}
+	}
+	return &FuncMap{funcs: funcs, fuzzy: fuzzy, parent: fm.parent, consts: consts}
 }
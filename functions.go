@@ -5,7 +5,6 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"math/big"
 	"regexp"
@@ -48,6 +47,7 @@ var builtinFunctions = map[string]NamedUserFunction{
 	"apply":      GetApplyFunction,
 	"make-array": GetMakeArrayFunction,
 	"error":      GetMakeErrorFunction,
+	"throw":      GetThrowFunction,
 	"aget":       GetArrayAccessFunction,
 	"aset!":      GetArrayAccessFunction,
 	"aindex":     GetArrayElementIndex,
@@ -301,6 +301,11 @@ func checkExistence(name string, args Args) (bool, error) {
 
 func GetHashAccessFunction(name string) UserFunction {
 	return func(env *Environment, args Args) (Sexp, error) {
+		if name == "hset!" {
+			if err := env.checkHashSet(args); err != nil {
+				return SexpNull, err
+			}
+		}
 		return hashAccess(name, args)
 	}
 }
@@ -450,14 +455,22 @@ func GetAppendFunction(name string) UserFunction {
 			return WrongNumberArguments(name, args.Len(), 2, Many)
 		}
 
+		var res Sexp
+		var err error
 		switch t := args.Get(0).(type) {
 		case SexpArray:
-			return SexpArray(append(t, args.GetAll()[1:]...)), nil
+			res = SexpArray(append(t, args.GetAll()[1:]...))
 		case SexpStr:
-			return AppendStr(t, args.GetAll()[1:]...)
+			if res, err = AppendStr(t, args.GetAll()[1:]...); err != nil {
+				return SexpNull, err
+			}
+		default:
+			return SexpNull, errors.New("First argument of append must be array or string but got " + InspectType(args.Get(0)))
 		}
-
-		return SexpNull, errors.New("First argument of append must be array or string but got " + InspectType(args.Get(0)))
+		if err = env.CheckAllocOf(res); err != nil {
+			return SexpNull, err
+		}
+		return res, nil
 	}
 }
 
@@ -466,7 +479,14 @@ func GetConcatFunction(name string) UserFunction {
 		if args.Len() < 2 {
 			return WrongNumberArguments(name, args.Len(), 2, Many)
 		}
-		return concatSexp(args)
+		res, err := concatSexp(args)
+		if err != nil {
+			return SexpNull, err
+		}
+		if err = env.CheckAllocOf(res); err != nil {
+			return SexpNull, err
+		}
+		return res, nil
 	}
 }
 
@@ -641,6 +661,9 @@ func GetMakeArrayFunction(name string) UserFunction {
 		default:
 			return SexpNull, errors.New("first argument must be integer")
 		}
+		if err := env.CheckAlloc(AllocArray, size); err != nil {
+			return SexpNull, err
+		}
 
 		var fill Sexp
 		if args.Len() == 2 {
@@ -660,6 +683,16 @@ func GetMakeArrayFunction(name string) UserFunction {
 
 func GetConstructorFunction(name string) UserFunction {
 	return func(env *Environment, args Args) (Sexp, error) {
+		switch name {
+		case "array", "list":
+			if err := env.CheckAlloc(AllocArray, args.Len()); err != nil {
+				return SexpNull, err
+			}
+		case "hash":
+			if err := env.CheckAlloc(AllocHash, args.Len()/2); err != nil {
+				return SexpNull, err
+			}
+		}
 		switch name {
 		case "array":
 			return SexpArray(args.GetAll()), nil
@@ -684,6 +717,15 @@ func GetMakeErrorFunction(name string) UserFunction {
 	}
 }
 
+func GetThrowFunction(name string) UserFunction {
+	return func(env *Environment, args Args) (Sexp, error) {
+		if args.Len() != 1 {
+			return WrongNumberArguments(name, args.Len(), 1)
+		}
+		return SexpNull, throwValue(args.Get(0))
+	}
+}
+
 func GetSymnumFunction(name string) UserFunction {
 	return func(env *Environment, args Args) (Sexp, error) {
 		if args.Len() != 1 {
@@ -724,15 +766,12 @@ func GetSourceFileFunction(name string) UserFunction {
 					expr = list.tail
 				}
 			case SexpStr:
-				var f io.ReadCloser
-				var err error
-
-				if f, err = env.fileReader.Open(string(t)); err != nil {
+				expressions, src, err := env.parseFile(string(t))
+				if err != nil {
 					return err
 				}
-				defer f.Close()
-
-				if err = env.SourceStream(f); err != nil {
+				defer env.loadingFile(src)()
+				if err = env.SourceExpressions(expressions); err != nil {
 					return err
 				}
 			default:
@@ -781,6 +820,12 @@ func withNameRegexp(exp string) FuntionOption {
 	}
 }
 
+func withFrame(frame *Frame) FuntionOption {
+	return func(f *SexpFunction) {
+		f.frame = frame
+	}
+}
+
 func MakeFunction(name string, nargs int, varargs bool, fun Function, opts ...FuntionOption) *SexpFunction {
 	var sfun = &SexpFunction{}
 	sfun.name = name
@@ -824,6 +869,9 @@ func GetStringifyFunction(name string) UserFunction {
 		if err := sexpToString(&sb, args); err != nil {
 			return SexpNull, err
 		}
+		if err := env.CheckAlloc(AllocString, sb.Len()); err != nil {
+			return SexpNull, err
+		}
 		return SexpStr(sb.String()), nil
 	}
 }
@@ -848,7 +896,7 @@ func GetAnyToInteger(name string) UserFunction {
 		case SexpFloat:
 			integer := new(big.Int)
 			val.v.Int(integer)
-			return SexpInt{v: integer}, nil
+			return newSexpIntBig(integer), nil
 		case SexpInt:
 			return val, nil
 		case SexpStr:
@@ -901,9 +949,16 @@ func GetAnyToBytes(name string) UserFunction {
 		}
 		switch v := args.Get(0).(type) {
 		case SexpStr:
+			if err := env.CheckAlloc(AllocBytes, len(v)); err != nil {
+				return SexpNull, err
+			}
 			return NewSexpBytes([]byte(string(v))), nil
 		case SexpInt:
-			return NewSexpBytes(v.ToBytes()), nil
+			bs := v.ToBytes()
+			if err := env.CheckAlloc(AllocBytes, len(bs)); err != nil {
+				return SexpNull, err
+			}
+			return NewSexpBytes(bs), nil
 		default:
 			return SexpNull, fmt.Errorf(`%s argument should be string/int but got %v`, name, InspectType(args.Get(0)))
 		}
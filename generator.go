@@ -11,7 +11,105 @@ type Generator struct {
 	funcname     string
 	tail         bool
 	scopes       int
+	scope        *lexScope
 	instructions []Instruction
+	// overloads is the function being compiled when it has several bodies,
+	// body is the arity of the body being compiled
+	overloads *SexpFunction
+	body      *SexpFunction
+	// recur is the loop or function recur jumps to, nil outside of them
+	recur *recurTarget
+}
+
+// recurTarget is where recur starts over, a loop or a function body.
+type recurTarget struct {
+	// nargs is the number of values recur takes
+	nargs int
+	// scopes is the number of scopes opened at its start
+	scopes int
+	// label marks the jumps of recur until the loop is generated, it is
+	// empty for functions which start over at their first instruction
+	label SexpSymbol
+	// tail is set if calls in its tail position are in the tail position
+	// of the function
+	tail bool
+}
+
+// lexScope is a frame being generated, parent is the frame enclosing it at
+// run time, nil for the global scope.
+type lexScope struct {
+	frame  *Frame
+	parent *lexScope
+	// dynamic scopes bind names only known at run time, like let with a
+	// list of bindings, names behind them are looked up by name
+	dynamic bool
+}
+
+// resolve finds the frame and slot of the local variable sym, ok is false
+// for globals.
+func (gen *Generator) resolve(sym SexpSymbol) (depth, slot int, ok bool) {
+	for s := gen.scope; s != nil; s = s.parent {
+		if slot = s.frame.slot(sym.number); slot >= 0 {
+			return depth, slot, true
+		}
+		if s.dynamic {
+			break
+		}
+		depth++
+	}
+	return 0, 0, false
+}
+
+// enterScope starts a frame for the bindings of a let or a function,
+// the caller emits the instructions pushing it at run time.
+func (gen *Generator) enterScope(dynamic bool) *Frame {
+	frame := &Frame{}
+	gen.scope = &lexScope{frame: frame, parent: gen.scope, dynamic: dynamic}
+	return frame
+}
+
+func (gen *Generator) leaveScope() {
+	gen.scope = gen.scope.parent
+}
+
+// getInstruction reads sym, from its slot if it is a local variable.
+func (gen *Generator) getInstruction(sym SexpSymbol) Instruction {
+	if depth, slot, ok := gen.resolve(sym); ok {
+		return Instruction{Op: OpGetLocal, Sym: sym, Depth: depth, Slot: slot}
+	}
+	return Instruction{Op: OpGet, Sym: sym}
+}
+
+// bindInstruction binds sym in the innermost scope, outside of functions
+// and let it is bound by name.
+func (gen *Generator) bindInstruction(sym SexpSymbol) Instruction {
+	if gen.scope == nil || gen.scope.dynamic {
+		return Instruction{Op: OpPut, Sym: sym}
+	}
+	return Instruction{Op: OpPutLocal, Sym: sym, Slot: gen.scope.frame.declare(sym)}
+}
+
+// setInstruction implements set! of sym.
+func (gen *Generator) setInstruction(sym SexpSymbol) Instruction {
+	if depth, slot, ok := gen.resolve(sym); ok {
+		return Instruction{Op: OpPutLocal, Sym: sym, IsSet: true, Depth: depth, Slot: slot}
+	}
+	return Instruction{Op: OpPut, Sym: sym, IsSet: true}
+}
+
+// subGenerator returns a generator for code spliced into gen's.
+func (gen *Generator) subGenerator() *Generator {
+	subgen := NewGenerator(gen.env)
+	subgen.scope = gen.scope
+	subgen.recur = gen.recur
+	subgen.overloads, subgen.body = gen.overloads, gen.body
+	return subgen
+}
+
+// tailCall reports whether a call generated now is in the tail position of
+// the function, so it may reuse the frame of the running function.
+func (gen *Generator) tailCall() bool {
+	return gen.tail && gen.recur != nil && gen.recur.tail
 }
 
 type Loop struct {
@@ -40,6 +138,9 @@ func (gen *Generator) AddInstructions(instr []Instruction) {
 }
 
 func (gen *Generator) AddInstruction(instr Instruction) {
+	if needsCallCache(instr.Op) && instr.Cache == nil {
+		instr.Cache = &callCache{}
+	}
 	gen.instructions = append(gen.instructions, instr)
 }
 
@@ -50,6 +151,9 @@ func (gen *Generator) GenerateBegin(expressions []Sexp) error {
 	if size == 0 {
 		return errors.New("No expressions found")
 	}
+	if gen.scope == nil {
+		gen.env.namespaces.prescan(expressions)
+	}
 	for _, expr := range expressions[:size-1] {
 		err := gen.Generate(expr)
 		if err != nil {
@@ -63,41 +167,41 @@ func (gen *Generator) GenerateBegin(expressions []Sexp) error {
 	return gen.Generate(expressions[size-1])
 }
 
-func buildSexpFun(env *Environment, name string, funcargs SexpArray,
+// buildSexpFun compiles a function, scope is the scope a closure is
+// created in and nil for functions that only see the globals.
+func buildSexpFun(env *Environment, scope *lexScope, name string, funcargs SexpArray,
 	funcbody []Sexp) (*SexpFunction, error) {
-	gen := NewGenerator(env)
-	gen.tail = true
-
 	if len(name) == 0 {
-		gen.funcname = env.GenSymbol("__anon").name
-	} else {
-		gen.funcname = name
+		name = env.GenSymbol("__anon").name
 	}
+	return buildBody(env, scope, name, funcargs, funcbody, nil, nil)
+}
 
-	argsyms := make([]SexpSymbol, len(funcargs))
-
-	for i, expr := range funcargs {
-		switch t := expr.(type) {
-		case SexpSymbol:
-			argsyms[i] = t
-		default:
-			return MissingFunction,
-				errors.New("function argument must be symbol")
-		}
-	}
-
-	varargs := false
-	nargs := len(funcargs)
-
-	if len(argsyms) >= 2 && argsyms[len(argsyms)-2].name == "&" {
-		argsyms[len(argsyms)-2] = argsyms[len(argsyms)-1]
-		argsyms = argsyms[0 : len(argsyms)-1]
-		varargs = true
-		nargs = len(argsyms) - 1
+// buildBody compiles a body of a function, overloads is the function with
+// several bodies it belongs to and body its arity, both are nil for
+// functions with a single body.
+func buildBody(env *Environment, scope *lexScope, name string, funcargs SexpArray,
+	funcbody []Sexp, overloads, body *SexpFunction) (*SexpFunction, error) {
+	gen := NewGenerator(env)
+	gen.tail = true
+	gen.scope = scope
+	gen.overloads = overloads
+	gen.body = body
+	frame := gen.enterScope(false)
+	gen.funcname = name
+
+	// the rest of the arguments is bound to the pattern after &
+	params := []Sexp(funcargs)
+	nargs, varargs := arityOf(funcargs)
+	if varargs {
+		params = append(params[:nargs:nargs], params[nargs+1])
+	}
+	if err := gen.bindValues(params); err != nil {
+		return MissingFunction, err
 	}
-
-	for i := len(argsyms) - 1; i >= 0; i-- {
-		gen.AddInstruction(Instruction{Op: OpPut, Sym: argsyms[i]})
+	gen.recur = &recurTarget{nargs: len(params), tail: true}
+	if gen.body == nil {
+		gen.body = MakeFunction(name, nargs, varargs, nil)
 	}
 
 	var doc string
@@ -112,11 +216,85 @@ func buildSexpFun(env *Environment, name string, funcargs SexpArray,
 	}
 	gen.AddInstruction(Instruction{Op: OpReturn})
 
-	newfunc := Function(gen.instructions)
-	return MakeFunction(gen.funcname, nargs, varargs, newfunc, WithDoc(doc)), nil
+	newfunc := Function(gen.code())
+	return MakeFunction(gen.funcname, nargs, varargs, newfunc, WithDoc(doc), withFrame(frame)), nil
+}
+
+// isOverload reports whether expr is a body of a function with several
+// of them, a list starting with the parameter vector.
+func isOverload(expr Sexp) bool {
+	pair, ok := expr.(*SexpPair)
+	if !ok {
+		return false
+	}
+	_, ok = pair.head.(SexpArray)
+	return ok
+}
+
+// arityOf returns the number of fixed parameters of funcargs and whether it
+// takes more arguments after &.
+func arityOf(funcargs SexpArray) (int, bool) {
+	n := len(funcargs)
+	if n >= 2 {
+		if sym, ok := funcargs[n-2].(SexpSymbol); ok && sym.name == "&" {
+			return n - 2, true
+		}
+	}
+	return n, false
+}
+
+// buildOverloads compiles a function with a body per arity, such as
+// (fn ([a] ...) ([a b & more] ...)). A call runs the body taking exactly
+// its number of arguments, or else the variadic body.
+func buildOverloads(env *Environment, scope *lexScope, name string, doc string, bodies []Sexp) (*SexpFunction, error) {
+	if len(name) == 0 {
+		name = env.GenSymbol("__anon").name
+	}
+	overloads := MakeFunction(name, 0, false, Function{}, WithDoc(doc))
+	var variadic *SexpFunction
+	for _, expr := range bodies {
+		if !isOverload(expr) {
+			return MissingFunction, fmt.Errorf("%s: function body must be a list starting with an argument vector", name)
+		}
+		nargs, varargs := arityOf(expr.(*SexpPair).head.(SexpArray))
+		body := MakeFunction(name, nargs, varargs, nil)
+		switch found, err := overloads.arity(nargs); {
+		case varargs && variadic != nil:
+			return MissingFunction, fmt.Errorf("%s: more than one variadic body", name)
+		case !varargs && err == nil && !found.varargs:
+			return MissingFunction, fmt.Errorf("%s: more than one body taking %d arguments", name, nargs)
+		}
+		if varargs {
+			variadic = body
+		}
+		overloads.arities = append(overloads.arities, body)
+	}
+	for _, body := range overloads.arities {
+		if variadic != nil && !body.varargs && body.nargs > variadic.nargs {
+			return MissingFunction, fmt.Errorf("%s: body taking %d arguments has more fixed arguments than the variadic body", name, body.nargs)
+		}
+	}
+	for i, expr := range bodies {
+		list, _ := ListToArray(expr)
+		compiled, err := buildBody(env, scope, name, list[0].(SexpArray), list[1:], overloads, overloads.arities[i])
+		if err != nil {
+			return MissingFunction, err
+		}
+		// the placeholder was compared by the tail calls of the bodies
+		*overloads.arities[i] = *compiled
+	}
+	return overloads, nil
 }
 
 func (gen *Generator) GenerateFn(args []Sexp) error {
+	if len(args) > 0 && isOverload(args[0]) {
+		sfun, err := buildOverloads(gen.env, gen.scope, "", "", args)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(Instruction{Op: OpPushClosure, ClosedFunc: sfun})
+		return nil
+	}
 	if len(args) < 2 {
 		return errors.New("malformed function definition")
 	}
@@ -131,7 +309,7 @@ func (gen *Generator) GenerateFn(args []Sexp) error {
 	}
 
 	funcbody := args[1:]
-	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody)
+	sfun, err := buildSexpFun(gen.env, gen.scope, "", funcargs, funcbody)
 	if err != nil {
 		return err
 	}
@@ -141,6 +319,12 @@ func (gen *Generator) GenerateFn(args []Sexp) error {
 }
 
 func (gen *Generator) GenerateDef(args []Sexp, isSet bool) error {
+	return gen.generateDef(args, isSet, false)
+}
+
+// generateDef compiles def, set! and def-, private definitions are only
+// visible in their namespace.
+func (gen *Generator) generateDef(args []Sexp, isSet bool, private bool) error {
 	if len(args) != 2 {
 		return errors.New("Wrong number of arguments to def")
 	}
@@ -158,29 +342,72 @@ func (gen *Generator) GenerateDef(args []Sexp, isSet bool) error {
 	if err != nil {
 		return err
 	}
-	gen.AddInstruction(Instruction{Op: OpPut, Sym: sym, IsSet: isSet})
+	if isSet {
+		if sym, err = gen.qualify(sym); err != nil {
+			return err
+		}
+		gen.AddInstruction(gen.setInstruction(sym))
+	} else {
+		gen.AddInstruction(gen.bindInstruction(gen.define(sym, private)))
+	}
+	gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
+	return nil
+}
+
+// GenerateDefconst compiles a global definition frozen once bound.
+func (gen *Generator) GenerateDefconst(args []Sexp) error {
+	if len(args) != 2 {
+		return errors.New("Wrong number of arguments to defconst")
+	}
+	sym, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("Definition name must by symbol")
+	}
+
+	gen.tail = false
+	if err := gen.Generate(args[1]); err != nil {
+		return err
+	}
+	gen.AddInstruction(Instruction{Op: OpPutConst, Sym: gen.define(sym, false)})
 	gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
 	return nil
 }
 
 func (gen *Generator) GenerateDefn(args []Sexp) error {
-	if len(args) < 3 {
+	return gen.generateDefn(args, false)
+}
+
+// generateDefn compiles defn and defn-, private functions are only visible
+// in their namespace.
+func (gen *Generator) generateDefn(args []Sexp, private bool) error {
+	// a function with a body per arity, with an optional doc string
+	var overloads []Sexp
+	var doc string
+	if len(args) > 1 && isOverload(args[1]) {
+		overloads = args[1:]
+	} else if len(args) > 2 && IsString(args[1]) && isOverload(args[2]) {
+		doc = string(args[1].(SexpStr))
+		overloads = args[2:]
+	}
+	if overloads == nil && len(args) < 3 {
 		return errors.New("Wrong number of arguments to defn")
 	}
 
 	var funcargs SexpArray
-	switch expr := args[1].(type) {
-	case SexpArray:
-		funcargs = expr
-	default:
-		return errors.New("function arguments must be in vector")
+	if overloads == nil {
+		switch expr := args[1].(type) {
+		case SexpArray:
+			funcargs = expr
+		default:
+			return errors.New("function arguments must be in vector")
+		}
 	}
 
 	var sym SexpSymbol
 	var dynName bool
 	switch expr := args[0].(type) {
 	case SexpSymbol:
-		sym = expr
+		sym = gen.define(expr, private)
 	case *SexpPair:
 		if IsList(expr) {
 			if err := gen.GenerateCall(expr); err != nil {
@@ -194,14 +421,20 @@ func (gen *Generator) GenerateDefn(args []Sexp) error {
 		return errors.New("Definition name must by symbol")
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:])
+	var sfun *SexpFunction
+	var err error
+	if overloads != nil {
+		sfun, err = buildOverloads(gen.env, nil, sym.name, doc, overloads)
+	} else {
+		sfun, err = buildSexpFun(gen.env, nil, sym.name, funcargs, args[2:])
+	}
 	if err != nil {
 		return err
 	}
 
 	if !dynName {
 		gen.AddInstruction(Instruction{Op: OpPush, Expr: sfun})
-		gen.AddInstruction(Instruction{Op: OpPut, Sym: sym})
+		gen.AddInstruction(gen.bindInstruction(sym))
 		gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
 	} else {
 		gen.AddInstruction(Instruction{Op: OpPush, Expr: sfun})
@@ -229,7 +462,7 @@ func (gen *Generator) GenerateDefmac(args []Sexp) error {
 	var regName *regexp.Regexp
 	switch expr := args[0].(type) {
 	case SexpSymbol:
-		sym = expr
+		sym = gen.define(expr, false)
 	case SexpStr:
 		if r, err := regexp.Compile(string(expr)); err != nil {
 			return err
@@ -241,7 +474,7 @@ func (gen *Generator) GenerateDefmac(args []Sexp) error {
 		return errors.New("Definition name must by symbol")
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:])
+	sfun, err := buildSexpFun(gen.env, nil, sym.name, funcargs, args[2:])
 	if err != nil {
 		return err
 	}
@@ -249,6 +482,9 @@ func (gen *Generator) GenerateDefmac(args []Sexp) error {
 		sfun.nameRegexp = regName
 	}
 
+	if gen.env.macros.IsFrozen(sym) {
+		return frozenError(sym)
+	}
 	gen.env.macros.Add(sym, sfun)
 	gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
 
@@ -306,7 +542,7 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	size := len(args)
 
-	subgen := NewGenerator(gen.env)
+	subgen := gen.subGenerator()
 	subgen.scopes = gen.scopes
 	subgen.tail = gen.tail
 	subgen.funcname = gen.funcname
@@ -314,7 +550,7 @@ func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	instructions := subgen.instructions
 
 	for i := size - 2; i >= 0; i-- {
-		subgen = NewGenerator(gen.env)
+		subgen = gen.subGenerator()
 		subgen.Generate(args[i])
 		subgen.AddInstruction(Instruction{Op: OpDup})
 		subgen.AddInstruction(Instruction{Op: OpBranch, Direction: or, Loc: len(instructions) + 2})
@@ -331,7 +567,7 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		return errors.New("missing default case")
 	}
 
-	subgen := NewGenerator(gen.env)
+	subgen := gen.subGenerator()
 	subgen.scopes = gen.scopes
 	subgen.funcname = gen.funcname
 	oldtail := gen.tail
@@ -352,6 +588,7 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 
 		subgen.Reset()
 		subgen.tail = oldtail
+		subgen.scopes = gen.scopes
 		err = subgen.Generate(args[2*i+1])
 		if err != nil {
 			return err
@@ -394,7 +631,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 }
 
 func (gen *Generator) generateLetArray(name string, bindings SexpArray, args []Sexp) error {
-	lstatements := make([]SexpSymbol, 0)
+	lstatements := make([]Sexp, 0)
 	rstatements := make([]Sexp, 0)
 
 	if len(bindings)%2 != 0 {
@@ -402,25 +639,26 @@ func (gen *Generator) generateLetArray(name string, bindings SexpArray, args []S
 	}
 
 	for i := 0; i < len(bindings)/2; i++ {
-		switch t := bindings[2*i].(type) {
-		case SexpSymbol:
-			lstatements = append(lstatements, t)
-		default:
-			return errors.New("cannot bind to non-symbol")
-		}
+		lstatements = append(lstatements, bindings[2*i])
 		rstatements = append(rstatements, bindings[2*i+1])
 	}
 
-	gen.AddInstruction(Instruction{Op: OpAddScope})
+	// the values are computed in the new scope, but the names are declared
+	// only once bound so the values still see the outer bindings
+	gen.AddInstruction(Instruction{Op: OpAddScope, Frame: gen.enterScope(false)})
 	gen.scopes++
 
+	oldtail := gen.tail
+	gen.tail = false
 	if name == "let*" {
 		for i, rs := range rstatements {
 			err := gen.Generate(rs)
 			if err != nil {
 				return err
 			}
-			gen.AddInstruction(Instruction{Op: OpPut, Sym: lstatements[i]})
+			if err := gen.generateBinding(lstatements[i]); err != nil {
+				return err
+			}
 		}
 	} else if name == "let" {
 		for _, rs := range rstatements {
@@ -429,16 +667,18 @@ func (gen *Generator) generateLetArray(name string, bindings SexpArray, args []S
 				return err
 			}
 		}
-		for i := len(lstatements) - 1; i >= 0; i-- {
-			gen.AddInstruction(Instruction{Op: OpPut, Sym: lstatements[i]})
+		if err := gen.bindValues(lstatements); err != nil {
+			return err
 		}
 	}
+	gen.tail = oldtail
 	err := gen.GenerateBegin(args)
 	if err != nil {
 		return err
 	}
 	gen.AddInstruction(Instruction{Op: OpRemoveScope})
 	gen.scopes--
+	gen.leaveScope()
 
 	return nil
 }
@@ -446,10 +686,14 @@ func (gen *Generator) generateLetArray(name string, bindings SexpArray, args []S
 func (gen *Generator) generateLetList(name string, bindings *SexpPair, args []Sexp) error {
 	gen.AddInstruction(Instruction{Op: OpAddScope})
 	gen.scopes++
+	gen.enterScope(true)
 
+	oldtail := gen.tail
+	gen.tail = false
 	if err := gen.Generate(bindings); err != nil {
 		return err
 	}
+	gen.tail = oldtail
 	gen.AddInstruction(Instruction{Op: OpBindlist})
 
 	err := gen.GenerateBegin(args)
@@ -458,7 +702,105 @@ func (gen *Generator) generateLetList(name string, bindings *SexpPair, args []Se
 	}
 	gen.AddInstruction(Instruction{Op: OpRemoveScope})
 	gen.scopes--
+	gen.leaveScope()
+
+	return nil
+}
+
+// GenerateLoop compiles (loop [bindings...] body...), a let whose body
+// starts over with new values of its bindings on (recur values...).
+//
+//	add scope; values; L: bind; body; rem scope
+//
+// recur in the tail position of the body leaves the scopes opened in the
+// loop and jumps to L.
+func (gen *Generator) GenerateLoop(args []Sexp) error {
+	if len(args) < 2 {
+		return errors.New("malformed loop statement")
+	}
+	bindings, ok := args[0].(SexpArray)
+	if !ok {
+		return errors.New("loop bindings must be in array")
+	}
+	if len(bindings)%2 != 0 {
+		return errors.New("uneven loop binding list")
+	}
+	patterns := make([]Sexp, 0, len(bindings)/2)
+	for i := 0; i < len(bindings); i += 2 {
+		patterns = append(patterns, bindings[i])
+	}
+
+	gen.AddInstruction(Instruction{Op: OpAddScope, Frame: gen.enterScope(false)})
+	gen.scopes++
+	oldtail := gen.tail
+	gen.tail = false
+	for i := 1; i < len(bindings); i += 2 {
+		if err := gen.Generate(bindings[i]); err != nil {
+			return err
+		}
+	}
+
+	label := gen.env.GenSymbol("__loop")
+	loopgen := gen.subGenerator()
+	loopgen.scopes = gen.scopes
+	loopgen.funcname = gen.funcname
+	loopgen.recur = &recurTarget{
+		nargs:  len(patterns),
+		scopes: gen.scopes,
+		label:  label,
+		tail:   oldtail && gen.recur != nil && gen.recur.tail,
+	}
+	if err := loopgen.bindValues(patterns); err != nil {
+		return err
+	}
+	loopgen.tail = true
+	if err := loopgen.GenerateBegin(args[1:]); err != nil {
+		return err
+	}
+	// nested loops have resolved their own jumps by now
+	for i, instr := range loopgen.instructions {
+		if instr.Op == OpJump && instr.Sym == label {
+			loopgen.instructions[i].Loc = -i
+			loopgen.instructions[i].Sym = SexpSymbol{}
+		}
+	}
+	gen.AddInstructions(loopgen.instructions)
+	gen.tail = oldtail
+
+	gen.AddInstruction(Instruction{Op: OpRemoveScope})
+	gen.scopes--
+	gen.leaveScope()
+	return nil
+}
 
+// GenerateRecur compiles (recur values...) in the tail position of a loop
+// or a function, which starts over with values bound to its bindings or
+// parameters. The rest of the arguments of a variadic function is passed
+// as a list.
+func (gen *Generator) GenerateRecur(args []Sexp) error {
+	target := gen.recur
+	if target == nil {
+		return errors.New("recur outside of loop or function")
+	}
+	if !gen.tail {
+		return errors.New("recur must be in tail position")
+	}
+	if len(args) != target.nargs {
+		return fmt.Errorf("recur expected %d arguments, got %d", target.nargs, len(args))
+	}
+	gen.tail = false
+	if err := gen.GenerateAll(args); err != nil {
+		return err
+	}
+	gen.tail = true
+	for i := target.scopes; i < gen.scopes; i++ {
+		gen.AddInstruction(Instruction{Op: OpRemoveScope})
+	}
+	if target.label.name == "" {
+		gen.AddInstruction(Instruction{Op: OpGoto})
+	} else {
+		gen.AddInstruction(Instruction{Op: OpJump, Sym: target.label})
+	}
 	return nil
 }
 
@@ -466,10 +808,13 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	if len(args) != 1 && len(args) != 2 {
 		return WrongGeneratorNumberArguments("assert", len(args), 1, 2)
 	}
+	oldtail := gen.tail
+	gen.tail = false
 	err := gen.Generate(args[0])
 	if err != nil {
 		return err
 	}
+	gen.tail = oldtail
 
 	if len(args) == 1 {
 		reterrmsg := fmt.Sprintf("Assertion failed: %s\n",
@@ -480,9 +825,8 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 		return nil
 	}
 
-	subgen := NewGenerator(gen.env)
+	subgen := gen.subGenerator()
 	subgen.scopes = gen.scopes
-	subgen.tail = gen.tail
 	subgen.funcname = gen.funcname
 	subgen.Generate(args[1])
 	instructions := subgen.instructions
@@ -494,6 +838,147 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	return nil
 }
 
+// GenerateTry compiles (try body... (catch e handler...) (finally cleanup...)),
+// both clauses are optional but at least one must be present. The layout is
+//
+//	try H1; body; endtry; jump OK
+//	H1: try H2; add scope; put e; handler; rem scope; endtry; jump OK
+//	H2: cleanup; pop; throw
+//	OK: cleanup; pop
+//
+// without finally H1 falls through to OK and H2 is omitted, without catch
+// H1 is H2.
+func (gen *Generator) GenerateTry(args []Sexp) error {
+	body, catchSym, catchBody, finallyBody, err := parseTryClauses(args)
+	if err != nil {
+		return err
+	}
+
+	subgen := gen.subGenerator()
+	subgen.scopes = gen.scopes
+	subgen.funcname = gen.funcname
+	if err := subgen.GenerateBegin(body); err != nil {
+		return err
+	}
+	bodyCode := subgen.instructions
+
+	var catchCode []Instruction
+	if catchSym != nil {
+		subgen.Reset()
+		subgen.funcname = gen.funcname
+		subgen.AddInstruction(Instruction{Op: OpAddScope, Frame: subgen.enterScope(false)})
+		subgen.AddInstruction(subgen.bindInstruction(*catchSym))
+		if len(catchBody) == 0 {
+			subgen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
+		} else if err := subgen.GenerateBegin(catchBody); err != nil {
+			return err
+		}
+		subgen.AddInstruction(Instruction{Op: OpRemoveScope})
+		subgen.leaveScope()
+		catchCode = subgen.instructions
+	}
+
+	var finallyCode []Instruction
+	if finallyBody != nil {
+		subgen.Reset()
+		subgen.scopes = gen.scopes
+		subgen.funcname = gen.funcname
+		if len(finallyBody) > 0 {
+			if err := subgen.GenerateBegin(finallyBody); err != nil {
+				return err
+			}
+			subgen.AddInstruction(Instruction{Op: OpPop})
+		}
+		finallyCode = subgen.instructions
+	}
+
+	if finallyBody == nil {
+		gen.AddInstruction(Instruction{Op: OpTry, Loc: len(bodyCode) + 3})
+		gen.AddInstructions(bodyCode)
+		gen.AddInstruction(Instruction{Op: OpEndTry})
+		gen.AddInstruction(Instruction{Op: OpJump, Loc: len(catchCode) + 1})
+		gen.AddInstructions(catchCode)
+		return nil
+	}
+
+	// errorPath runs the catch clause and the cleanup after an error
+	var errorPath []Instruction
+	if catchSym != nil {
+		errorPath = append(errorPath, Instruction{Op: OpTry, Loc: len(catchCode) + 3})
+		errorPath = append(errorPath, catchCode...)
+		errorPath = append(errorPath, Instruction{Op: OpEndTry})
+		errorPath = append(errorPath, Instruction{Op: OpJump, Loc: len(finallyCode) + 2})
+	}
+	errorPath = append(errorPath, finallyCode...)
+	errorPath = append(errorPath, Instruction{Op: OpThrow})
+
+	gen.AddInstruction(Instruction{Op: OpTry, Loc: len(bodyCode) + 3})
+	gen.AddInstructions(bodyCode)
+	gen.AddInstruction(Instruction{Op: OpEndTry})
+	gen.AddInstruction(Instruction{Op: OpJump, Loc: len(errorPath) + 1})
+	gen.AddInstructions(errorPath)
+	gen.AddInstructions(finallyCode)
+	return nil
+}
+
+func parseTryClauses(args []Sexp) (body []Sexp, catchSym *SexpSymbol, catchBody []Sexp, finallyBody []Sexp, err error) {
+	clauseName := func(expr Sexp) string {
+		if pair, ok := expr.(*SexpPair); ok {
+			if sym, ok := pair.head.(SexpSymbol); ok && (sym.name == "catch" || sym.name == "finally") {
+				return sym.name
+			}
+		}
+		return ""
+	}
+	i := 0
+	for i < len(args) && clauseName(args[i]) == "" {
+		i++
+	}
+	body = args[:i]
+	if len(body) == 0 {
+		return nil, nil, nil, nil, errors.New("try requires a body")
+	}
+	for ; i < len(args); i++ {
+		clause, _ := ListToArray(args[i])
+		switch clauseName(args[i]) {
+		case "catch":
+			if catchSym != nil || finallyBody != nil {
+				return nil, nil, nil, nil, errors.New("catch must appear once and before finally")
+			}
+			if len(clause) < 2 || !IsSymbol(clause[1]) {
+				return nil, nil, nil, nil, errors.New("catch requires a symbol to bind the error")
+			}
+			sym := clause[1].(SexpSymbol)
+			catchSym, catchBody = &sym, clause[2:]
+		case "finally":
+			if finallyBody != nil {
+				return nil, nil, nil, nil, errors.New("finally must appear once")
+			}
+			finallyBody = clause[1:]
+		default:
+			return nil, nil, nil, nil, errors.New("catch/finally must be the last forms of try")
+		}
+	}
+	if catchSym == nil && finallyBody == nil {
+		return nil, nil, nil, nil, errors.New("try requires a catch or finally clause")
+	}
+	return
+}
+
+func (gen *Generator) GenerateThrow(args []Sexp) error {
+	if len(args) != 1 {
+		return WrongGeneratorNumberArguments("throw", len(args), 1)
+	}
+	oldtail := gen.tail
+	gen.tail = false
+	if err := gen.Generate(args[0]); err != nil {
+		return err
+	}
+	gen.tail = oldtail
+	gen.AddInstruction(Instruction{Op: OpThrow})
+	return nil
+}
+
 func (gen *Generator) GenerateInclude(args []Sexp) error {
 	if len(args) < 1 {
 		return WrongGeneratorNumberArguments("include", len(args), 1)
@@ -502,6 +987,13 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 	var err error
 	var exps []Sexp
 
+	oldtail := gen.tail
+	gen.tail = false
+	// a namespace declared by an included file ends with it
+	namespaces := gen.env.namespaces
+	current := namespaces.current
+	defer func() { namespaces.current = current }()
+
 	var sourceItem func(item Sexp) error
 
 	sourceItem = func(item Sexp) error {
@@ -522,11 +1014,13 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 				expr = list.tail
 			}
 		case SexpStr:
-			exps, err = gen.env.ParseFile(string(t))
+			var src sourceFile
+			exps, src, err = gen.env.parseFile(string(t))
 			if err != nil {
 				return err
 			}
 
+			defer gen.env.loadingFile(src)()
 			err = gen.GenerateBegin(exps)
 			if err != nil {
 				return err
@@ -545,6 +1039,7 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 			return err
 		}
 	}
+	gen.tail = oldtail
 
 	return nil
 }
@@ -563,18 +1058,36 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		return gen.GenerateDef(args, false)
 	case "set!":
 		return gen.GenerateDef(args, true)
+	case "def-":
+		return gen.generateDef(args, false, true)
+	case "defconst":
+		return gen.GenerateDefconst(args)
 	case "fn":
 		return gen.GenerateFn(args)
 	case "defn":
 		return gen.GenerateDefn(args)
+	case "defn-":
+		return gen.generateDefn(args, true)
+	case "ns":
+		return gen.GenerateNs(args)
+	case "require":
+		return gen.GenerateRequire(args)
 	case "begin":
 		return gen.GenerateBegin(args)
 	case "let":
 		return gen.GenerateLet("let", args)
 	case "let*":
 		return gen.GenerateLet("let*", args)
+	case "loop":
+		return gen.GenerateLoop(args)
+	case "recur":
+		return gen.GenerateRecur(args)
 	case "assert":
 		return gen.GenerateAssert(args)
+	case "try":
+		return gen.GenerateTry(args)
+	case "throw":
+		return gen.GenerateThrow(args)
 	case "defmac":
 		return gen.GenerateDefmac(args)
 	case "macexpand":
@@ -625,25 +1138,42 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		return gen.GenerateGetSexpStr(sym.name, args)
 	}
 
+	sym, err := gen.qualify(sym)
+	if err != nil {
+		return err
+	}
 	macro, found := gen.env.macros.Find(sym)
 	if found {
 		// calling Apply on the current environment will screw up
 		// the stack, creating a duplicate environment is safer
 		env := gen.env.Duplicate()
-		expr, err := env.Apply(macro, prependCallName(macro, sym, args))
+		macroArgs := prependCallName(macro, sym, args)
+		expr, err := env.Apply(macro, macroArgs)
 		if err != nil {
+			if macro.user {
+				// Go macros do not run on the VM, record their frame here
+				// as Run does for script macros
+				err = &RuntimeError{Err: err, Stack: []StackFrame{{Function: macro.name, PC: -1, Nargs: macroArgs.Len()}}}
+			}
 			return err
 		}
+		// the expansion may use the private names of the macro's namespace
+		namespaces := gen.env.namespaces
+		expanding := namespaces.expanding
+		namespaces.expanding = namespaces.owner(sym)
+		defer func() { namespaces.expanding = expanding }()
 		return gen.Generate(expr)
 	}
 
 	oldtail := gen.tail
 	gen.tail = false
-	err := gen.GenerateAll(args)
+	err = gen.GenerateAll(args)
 	if err != nil {
 		return err
 	}
-	if oldtail && sym.name == gen.funcname {
+	gen.tail = oldtail
+	switch {
+	case gen.tailCall() && sym.name == gen.funcname && gen.selfArity(len(args)):
 		// to do a tail call
 		// pop off all the extra scopes
 		// then jump to beginning of function
@@ -652,17 +1182,40 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		}
 		gen.AddInstruction(Instruction{Op: OpPrepare, Sym: sym, Nargs: len(args)})
 		gen.AddInstruction(Instruction{Op: OpGoto})
-	} else {
+	case gen.tailCall():
+		gen.AddInstruction(Instruction{Op: OpTailCall, Sym: sym, Nargs: len(args)})
+	default:
 		gen.AddInstruction(Instruction{Op: OpCall, Sym: sym, Nargs: len(args)})
 	}
-	gen.tail = oldtail
 	return nil
 }
 
+// selfArity reports whether a call of the function being compiled with
+// nargs arguments runs the body being compiled, so a tail call can jump
+// to its start.
+func (gen *Generator) selfArity(nargs int) bool {
+	if gen.overloads == nil {
+		return nargs == gen.body.nargs || gen.body.varargs && nargs > gen.body.nargs
+	}
+	body, err := gen.overloads.arity(nargs)
+	return err == nil && body == gen.body
+}
+
 func (gen *Generator) GenerateDispatch(fun Sexp, args []Sexp) error {
-	gen.GenerateAll(args)
-	gen.Generate(fun)
-	gen.AddInstruction(Instruction{Op: OpDispatch, Nargs: len(args)})
+	oldtail := gen.tail
+	gen.tail = false
+	if err := gen.GenerateAll(args); err != nil {
+		return err
+	}
+	if err := gen.Generate(fun); err != nil {
+		return err
+	}
+	gen.tail = oldtail
+	if gen.tailCall() {
+		gen.AddInstruction(Instruction{Op: OpTailDispatch, Nargs: len(args)})
+	} else {
+		gen.AddInstruction(Instruction{Op: OpDispatch, Nargs: len(args)})
+	}
 	return nil
 }
 
@@ -676,7 +1229,10 @@ func (gen *Generator) GenerateCall(expr *SexpPair) error {
 }
 
 func (gen *Generator) GenerateArray(arr SexpArray) error {
+	oldtail := gen.tail
+	gen.tail = false
 	err := gen.GenerateAll(arr)
+	gen.tail = oldtail
 	if err != nil {
 		return err
 	}
@@ -687,15 +1243,20 @@ func (gen *Generator) GenerateArray(arr SexpArray) error {
 func (gen *Generator) Generate(expr Sexp) error {
 	switch e := expr.(type) {
 	case SexpSymbol:
-		gen.AddInstruction(Instruction{Op: OpGet, Sym: e})
+		sym, err := gen.qualify(e)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(gen.getInstruction(sym))
 		return nil
 	case *SexpPair:
 		if IsList(e) {
+			start := len(gen.instructions)
 			err := gen.GenerateCall(e)
 			if err != nil {
-				return fmt.Errorf("Error generating %s: %v",
-					expr.SexpString(), err)
+				return gen.compileError(e, err)
 			}
+			gen.stampPosition(start, e.pos)
 			return nil
 		} else {
 			gen.AddInstruction(Instruction{Op: OpPush, Expr: expr})
@@ -709,6 +1270,37 @@ func (gen *Generator) Generate(expr Sexp) error {
 	return nil
 }
 
+// stampPosition sets pos on the instructions emitted since start, those of
+// nested lists already carry their own position.
+func (gen *Generator) stampPosition(start int, pos *Position) {
+	if pos == nil {
+		return
+	}
+	for i := start; i < len(gen.instructions); i++ {
+		if gen.instructions[i].Pos == nil {
+			gen.instructions[i].Pos = pos
+		}
+	}
+}
+
+// compileError reports err at the position of the innermost list, errors
+// already carrying a position keep it.
+func (gen *Generator) compileError(e *SexpPair, err error) error {
+	if ce, ok := err.(*CompileError); ok {
+		return &CompileError{
+			Err: fmt.Errorf("Error generating %s: %w", e.SexpString(), ce.Err),
+			Pos: ce.Pos,
+		}
+	}
+	if e.pos == nil {
+		return fmt.Errorf("Error generating %s: %w", e.SexpString(), err)
+	}
+	return &CompileError{
+		Err: fmt.Errorf("Error generating %s: %w", e.SexpString(), err),
+		Pos: *e.pos,
+	}
+}
+
 func (gen *Generator) GenerateAll(expressions []Sexp) error {
 	for _, expr := range expressions {
 		err := gen.Generate(expr)
@@ -735,7 +1327,7 @@ func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
 
 	// need to handle arrays, since they can have unquotes
 	// in them too.
-	switch arg.(type) {
+	switch a := arg.(type) {
 	case SexpArray:
 		gen.generateSyntaxQuoteArray(arg)
 		return nil
@@ -745,6 +1337,12 @@ func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
 		}
 		gen.generateSyntaxQuoteList(arg)
 		return nil
+	case SexpSymbol:
+		// names of the namespace are qualified so the expansion finds them
+		// wherever the macro is used
+		if sym, err := gen.env.namespaces.qualify(gen.env, a); err == nil {
+			arg = sym
+		}
 	}
 	gen.AddInstruction(Instruction{Op: OpPush, Expr: arg})
 	return nil
@@ -778,14 +1376,19 @@ func (gen *Generator) generateSyntaxQuoteList(arg Sexp) error {
 			issymbol = false
 		}
 		if issymbol {
+			oldtail := gen.tail
+			gen.tail = false
 			if sym.name == "unquote" {
 				gen.Generate(quotebody[1])
+				gen.tail = oldtail
 				return nil
 			} else if sym.name == "unquote-splicing" {
 				gen.Generate(quotebody[1])
+				gen.tail = oldtail
 				gen.AddInstruction(Instruction{Op: OpExplode})
 				return nil
 			}
+			gen.tail = oldtail
 		}
 	}
 
@@ -830,10 +1433,18 @@ func (gen *Generator) GenerateSharpQuote(args []Sexp) error {
 
 	switch expr := arg.(type) {
 	case SexpSymbol:
-		gen.AddInstruction(Instruction{Op: OpGet, Sym: expr})
+		sym, err := gen.qualify(expr)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(gen.getInstruction(sym))
 		return nil
 	case *SexpPair:
-		if err := gen.Generate(arg); err != nil {
+		oldtail := gen.tail
+		gen.tail = false
+		err := gen.Generate(arg)
+		gen.tail = oldtail
+		if err != nil {
 			return err
 		}
 		gen.AddInstruction(Instruction{Op: OpRefSym})
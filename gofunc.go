@@ -0,0 +1,529 @@
+package glisp
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sexpType    = reflect.TypeOf((*Sexp)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	envType     = reflect.TypeOf((*Environment)(nil))
+	bigIntType  = reflect.TypeOf(big.Int{})
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// goConverter converts the values of a Go type registered by
+// RegisterGoConverter.
+type goConverter struct {
+	toSexp   func(any) Sexp
+	fromSexp func(Sexp) (any, bool)
+}
+
+// RegisterGoConverter makes functions added by AddGoFunc convert values of
+// typ with toSexp and fromSexp, fromSexp reports false for values it does
+// not take. Converters must be registered before the functions using them.
+func (env *Environment) RegisterGoConverter(typ reflect.Type, toSexp func(any) Sexp, fromSexp func(Sexp) (any, bool)) {
+	// replace the map, environments duplicated from env share it
+	converters := make(map[reflect.Type]goConverter, len(env.converters)+1)
+	for k, v := range env.converters {
+		converters[k] = v
+	}
+	converters[typ] = goConverter{toSexp: toSexp, fromSexp: fromSexp}
+	env.converters = converters
+}
+
+// AddGoFunc adds a Go function of any signature, arguments and results are
+// converted between glisp and Go values:
+//
+//   - integers, including *big.Int, floats, strings, bools and []byte
+//   - slices from arrays and lists, maps and structs from hashes, keyed by
+//     the json tag or the name of struct fields
+//   - time.Time from RFC 3339 strings, or the values of the time extension
+//   - pointers, Sexp values as they are and any as the closest Go value
+//
+// Variadic functions take any number of trailing arguments. Parameters of
+// type *Environment or context.Context coming first receive the calling
+// environment and the context of the evaluation. The function may return a
+// value, an error or both, a non-nil error fails the call.
+func (env *Environment) AddGoFunc(name string, fn any, opts ...FuntionOption) error {
+	f, err := env.makeGoFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	return env.BindGlobal(name, MakeUserFunction(name, f, opts...))
+}
+
+func (env *Environment) makeGoFunc(name string, fn any) (UserFunction, error) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s should be function but got %T", name, fn)
+	}
+	var host []reflect.Type
+	for len(host) < ft.NumIn() && (ft.In(len(host)) == envType || ft.In(len(host)) == contextType) {
+		host = append(host, ft.In(len(host)))
+	}
+	params := make([]reflect.Type, 0, ft.NumIn()-len(host))
+	for i := len(host); i < ft.NumIn(); i++ {
+		params = append(params, ft.In(i))
+	}
+	variadic := ft.IsVariadic() && len(params) > 0
+	nfixed := len(params)
+	if variadic {
+		nfixed--
+		params[nfixed] = params[nfixed].Elem()
+	}
+	for _, t := range params {
+		if !env.convertible(t) {
+			return nil, fmt.Errorf("%s: unsupported argument type %s", name, t)
+		}
+	}
+	returnsErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+	nvalues := ft.NumOut()
+	if returnsErr {
+		nvalues--
+	}
+	if nvalues > 1 {
+		return nil, fmt.Errorf("%s should return at most a value and an error", name)
+	}
+	if nvalues == 1 && !env.convertible(ft.Out(0)) {
+		return nil, fmt.Errorf("%s: unsupported result type %s", name, ft.Out(0))
+	}
+
+	return func(env *Environment, args Args) (Sexp, error) {
+		if variadic && args.Len() < nfixed {
+			return WrongNumberArguments(name, args.Len(), nfixed, Many)
+		}
+		if !variadic && args.Len() != nfixed {
+			return WrongNumberArguments(name, args.Len(), nfixed)
+		}
+		in := make([]reflect.Value, 0, len(host)+args.Len())
+		for _, t := range host {
+			if t == envType {
+				in = append(in, reflect.ValueOf(env))
+			} else {
+				in = append(in, reflect.ValueOf(env.Context()))
+			}
+		}
+		for i := 0; i < args.Len(); i++ {
+			t := params[min(i, len(params)-1)]
+			v, ok := env.goValue(args.Get(i), t)
+			if !ok {
+				return WrongArgumentType(name, i+1, t.String(), args.Get(i))
+			}
+			in = append(in, v)
+		}
+		out := fv.Call(in)
+		if returnsErr {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return SexpNull, err
+			}
+		}
+		if nvalues == 0 {
+			return SexpNull, nil
+		}
+		ret, err := env.sexpValue(out[0])
+		if err != nil {
+			return SexpNull, fmt.Errorf("%s %v", name, err)
+		}
+		return ret, nil
+	}, nil
+}
+
+// convertible reports whether values of t can be converted by AddGoFunc.
+func (env *Environment) convertible(t reflect.Type) bool {
+	return env.convertibleType(t, make(map[reflect.Type]bool))
+}
+
+// convertibleType is convertible for types within the types being checked,
+// seen breaks the recursion of types referring to themselves.
+func (env *Environment) convertibleType(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if _, ok := env.converters[t]; ok || t == bigIntType || t == timeType || seen[t] {
+		return true
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Interface,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice, reflect.Pointer:
+		return env.convertibleType(t.Elem(), seen)
+	case reflect.Map:
+		return env.convertibleType(t.Key(), seen) && env.convertibleType(t.Elem(), seen)
+	case reflect.Struct:
+		for _, f := range structFieldsOf(t) {
+			if !env.convertibleType(t.Field(f.index).Type, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return t.Implements(sexpType)
+}
+
+// goValue converts expr to a Go value of type t.
+func (env *Environment) goValue(expr Sexp, t reflect.Type) (reflect.Value, bool) {
+	if c, ok := env.converters[t]; ok && c.fromSexp != nil {
+		if v, ok := c.fromSexp(expr); ok {
+			rv := reflect.ValueOf(v)
+			return rv, rv.IsValid() && rv.Type().AssignableTo(t)
+		}
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if v := goAny(expr); v != nil {
+			return reflect.ValueOf(v), true
+		}
+		return reflect.Zero(t), true
+	}
+	if reflect.TypeOf(expr).AssignableTo(t) {
+		return reflect.ValueOf(expr), true
+	}
+	rv := reflect.New(t).Elem()
+	switch t {
+	case bigIntType:
+		i, ok := expr.(SexpInt)
+		if ok {
+			rv.Set(reflect.ValueOf(new(big.Int).Set(i.toBig())).Elem())
+		}
+		return rv, ok
+	case timeType:
+		str, ok := expr.(SexpStr)
+		if !ok {
+			return rv, false
+		}
+		tm, err := time.Parse(time.RFC3339Nano, string(str))
+		rv.Set(reflect.ValueOf(tm))
+		return rv, err == nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := expr.(SexpBool)
+		rv.SetBool(bool(b))
+		return rv, ok
+	case reflect.String:
+		switch e := expr.(type) {
+		case SexpStr:
+			rv.SetString(string(e))
+			return rv, true
+		case SexpSymbol:
+			rv.SetString(e.name)
+			return rv, true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch e := expr.(type) {
+		case SexpInt:
+			if !e.IsInt64() {
+				return rv, false
+			}
+			n = e.ToInt64()
+		case SexpChar:
+			n = int64(e)
+		default:
+			return rv, false
+		}
+		rv.SetInt(n)
+		return rv, !rv.OverflowInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := expr.(SexpInt)
+		if !ok || !i.IsUint64() {
+			return rv, false
+		}
+		rv.SetUint(i.ToUint64())
+		return rv, !rv.OverflowUint(i.ToUint64())
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch e := expr.(type) {
+		case SexpFloat:
+			f = e.ToFloat64()
+		case SexpInt:
+			f = NewSexpFloatInt(e).ToFloat64()
+		default:
+			return rv, false
+		}
+		rv.SetFloat(f)
+		return rv, !rv.OverflowFloat(f)
+	case reflect.Slice:
+		return env.goSlice(expr, t)
+	case reflect.Map:
+		if expr == SexpNull {
+			return rv, true
+		}
+		hash, ok := expr.(*SexpHash)
+		if !ok {
+			return rv, false
+		}
+		rv.Set(reflect.MakeMapWithSize(t, len(hash.Map)))
+		hash.Visit(func(k, v Sexp) bool {
+			var key, val reflect.Value
+			if key, ok = env.goValue(k, t.Key()); ok {
+				if val, ok = env.goValue(v, t.Elem()); ok {
+					rv.SetMapIndex(key, val)
+				}
+			}
+			return ok
+		})
+		return rv, ok
+	case reflect.Struct:
+		hash, ok := expr.(*SexpHash)
+		if !ok {
+			return rv, false
+		}
+		fields := structFieldsOf(t)
+		hash.Visit(func(k, v Sexp) bool {
+			var name string
+			switch k := k.(type) {
+			case SexpStr:
+				name = string(k)
+			case SexpSymbol:
+				name = k.name
+			default:
+				return true
+			}
+			f, found := findStructField(fields, name)
+			if !found {
+				return true
+			}
+			var val reflect.Value
+			if val, ok = env.goValue(v, t.Field(f.index).Type); ok {
+				rv.Field(f.index).Set(val)
+			}
+			return ok
+		})
+		return rv, ok
+	case reflect.Pointer:
+		if expr == SexpNull {
+			return rv, true
+		}
+		elem, ok := env.goValue(expr, t.Elem())
+		if ok {
+			rv.Set(reflect.New(t.Elem()))
+			rv.Elem().Set(elem)
+		}
+		return rv, ok
+	}
+	return rv, false
+}
+
+// goSlice converts an array or a list to a slice of type t, and strings or
+// bytes to []byte.
+func (env *Environment) goSlice(expr Sexp, t reflect.Type) (reflect.Value, bool) {
+	rv := reflect.New(t).Elem()
+	if t.Elem().Kind() == reflect.Uint8 {
+		switch e := expr.(type) {
+		case SexpBytes:
+			rv.SetBytes(append([]byte(nil), e.Bytes()...))
+			return rv, true
+		case SexpStr:
+			rv.SetBytes([]byte(e))
+			return rv, true
+		}
+	}
+	var items []Sexp
+	switch e := expr.(type) {
+	case SexpArray:
+		items = e
+	case *SexpPair:
+		var err error
+		if items, err = ListToArray(e); err != nil {
+			return rv, false
+		}
+	default:
+		return rv, expr == SexpNull
+	}
+	rv.Set(reflect.MakeSlice(t, len(items), len(items)))
+	for i, item := range items {
+		v, ok := env.goValue(item, t.Elem())
+		if !ok {
+			return rv, false
+		}
+		rv.Index(i).Set(v)
+	}
+	return rv, true
+}
+
+// goAny converts expr to the closest Go value, values without one are
+// returned as they are.
+func goAny(expr Sexp) any {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		if e == SexpNull {
+			return nil
+		}
+	case SexpInt:
+		if e.IsInt64() {
+			return e.ToInt64()
+		}
+		return new(big.Int).Set(e.toBig())
+	case SexpFloat:
+		return e.ToFloat64()
+	case SexpStr:
+		return string(e)
+	case SexpBool:
+		return bool(e)
+	case SexpChar:
+		return rune(e)
+	case SexpBytes:
+		return append([]byte(nil), e.Bytes()...)
+	case SexpArray:
+		ret := make([]any, len(e))
+		for i, item := range e {
+			ret[i] = goAny(item)
+		}
+		return ret
+	case *SexpPair:
+		if items, err := ListToArray(e); err == nil {
+			return goAny(SexpArray(items))
+		}
+	case *SexpHash:
+		ret := make(map[string]any, len(e.Map))
+		e.Visit(func(k, v Sexp) bool {
+			if str, ok := goAny(k).(string); ok {
+				ret[str] = goAny(v)
+			} else {
+				ret[k.SexpString()] = goAny(v)
+			}
+			return true
+		})
+		return ret
+	}
+	return expr
+}
+
+// sexpValue converts a Go value to a glisp value.
+func (env *Environment) sexpValue(v reflect.Value) (Sexp, error) {
+	if !v.IsValid() {
+		return SexpNull, nil
+	}
+	t := v.Type()
+	if c, ok := env.converters[t]; ok && c.toSexp != nil {
+		return c.toSexp(v.Interface()), nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Func:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+	}
+	if t.Implements(sexpType) {
+		return v.Interface().(Sexp), nil
+	}
+	switch t {
+	case bigIntType:
+		i := v.Interface().(big.Int)
+		return newSexpIntBig(new(big.Int).Set(&i)), nil
+	case timeType:
+		return SexpStr(v.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return SexpBool(v.Bool()), nil
+	case reflect.String:
+		return SexpStr(v.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewSexpInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return NewSexpUint64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return NewSexpFloat(v.Float()), nil
+	case reflect.Interface, reflect.Pointer:
+		return env.sexpValue(v.Elem())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return NewSexpBytes(append([]byte(nil), v.Bytes()...)), nil
+		}
+		arr := make(SexpArray, v.Len())
+		for i := range arr {
+			item, err := env.sexpValue(v.Index(i))
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = item
+		}
+		return arr, nil
+	case reflect.Map:
+		hash, _ := MakeHash(MakeArgs())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := env.sexpValue(iter.Key())
+			if err != nil {
+				return SexpNull, err
+			}
+			val, err := env.sexpValue(iter.Value())
+			if err != nil {
+				return SexpNull, err
+			}
+			if err = hash.HashSet(key, val); err != nil {
+				return SexpNull, err
+			}
+		}
+		return hash, nil
+	case reflect.Struct:
+		hash, _ := MakeHash(MakeArgs())
+		for _, f := range structFieldsOf(t) {
+			val, err := env.sexpValue(v.Field(f.index))
+			if err != nil {
+				return SexpNull, err
+			}
+			hash.HashSet(SexpStr(f.name), val)
+		}
+		return hash, nil
+	}
+	return SexpNull, fmt.Errorf("cannot convert %s to glisp value", t)
+}
+
+// structField is an exported field of a struct converted to and from a
+// hash, named by its json tag or else its name.
+type structField struct {
+	index int
+	name  string
+}
+
+var structFieldCache sync.Map
+
+func structFieldsOf(t reflect.Type) []structField {
+	if fields, ok := structFieldCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields = append(fields, structField{index: i, name: name})
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+// findStructField finds the field named name, or else the field named like
+// it ignoring case.
+func findStructField(fields []structField, name string) (structField, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return structField{}, false
+}
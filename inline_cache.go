@@ -0,0 +1,60 @@
+package glisp
+
+import "sync/atomic"
+
+// bindEpoch changes whenever a binding by name may hide or replace a
+// function, calls compare it with the epoch their callee was cached at.
+var bindEpoch atomic.Uint64
+
+// callCache is the inline cache of an OpCall, OpPrepare or OpTailCall
+// instruction, it remembers the global function the symbol of the call
+// resolved to. The instructions of a function are shared by its clones and
+// coroutines, so the entry is replaced atomically rather than updated.
+type callCache struct {
+	entry atomic.Pointer[callEntry]
+}
+
+// callEntry is valid while no binding changed and the call runs with the
+// same global scope, over the same base if it was made by ForkGlobal, and
+// as many scopes above it. The local variables of the scopes above are
+// known at compile time, so with the same number of them the call sees the
+// same names. Calls under a scope binding names at run time are not cached.
+type callEntry struct {
+	fn      *SexpFunction
+	globals *ScopeLayer
+	base    *ScopeLayer
+	depth   int
+	epoch   uint64
+}
+
+// needsCallCache reports whether instructions of op get an inline cache.
+func needsCallCache(op Opcode) bool {
+	return op == OpCall || op == OpPrepare || op == OpTailCall
+}
+
+// lookupCallee resolves the function called by sym through the scopes, then
+// among the builtins.
+func (env *Environment) lookupCallee(sym SexpSymbol, cache *callCache) (Sexp, error) {
+	stack := env.scopestack
+	if cache != nil {
+		if e := cache.entry.Load(); e != nil && e.epoch == bindEpoch.Load() &&
+			e.globals == stack.bottom && e.base == stack.base() && e.depth == stack.Depth() {
+			return e.fn, nil
+		}
+	}
+	// load the epoch first, a binding made during the lookup invalidates
+	// the entry
+	epoch := bindEpoch.Load()
+	obj, err := stack.LookupSymbol(sym)
+	if err != nil {
+		f, ok := env.builtins[sym.number]
+		if !ok {
+			return SexpNull, err
+		}
+		obj = f
+	}
+	if f, ok := obj.(*SexpFunction); ok && cache != nil && !stack.declaredLocally(sym) && !stack.hasDynamicScope() {
+		cache.entry.Store(&callEntry{fn: f, globals: stack.bottom, base: stack.base(), depth: stack.Depth(), epoch: epoch})
+	}
+	return obj, nil
+}
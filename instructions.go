@@ -21,16 +21,25 @@ const (
 	// Variable access
 	OpGet
 	OpPut
+	OpGetLocal // Read a local variable resolved by the generator
+	OpPutLocal // Bind or set a local variable resolved by the generator
 	OpBindDynFun
+	OpPutConst // Bind a global variable and freeze it
 
 	// Control flow
-	OpJump     // Unconditional relative jump
-	OpGoto     // Unconditional absolute jump
-	OpBranch   // Conditional relative jump
-	OpReturn   // Return from function
-	OpCall     // Call a function by symbol
-	OpPrepare  // Prepare for tail call
-	OpDispatch // Call a function from stack
+	OpJump         // Unconditional relative jump
+	OpGoto         // Unconditional absolute jump
+	OpBranch       // Conditional relative jump
+	OpReturn       // Return from function
+	OpCall         // Call a function by symbol
+	OpPrepare      // Prepare for tail call
+	OpDispatch     // Call a function from stack
+	OpTailCall     // Call a function by symbol in place of the running one
+	OpTailDispatch // Call a function from stack in place of the running one
+	OpTry          // Install an error handler, relative jump to it on error
+	OpEndTry       // Remove the innermost error handler
+	OpThrow        // Raise the value on the stack as an error
+	OpRequire      // Relative jump past the code of a module already loaded
 
 	// Scope
 	OpAddScope
@@ -42,6 +51,9 @@ const (
 	OpVectorize
 	OpBindlist
 	OpRefSym
+	OpUnpackNth  // Replace a sequence by one of its elements
+	OpUnpackRest // Replace a sequence by its elements from an index on
+	OpUnpackKey  // Replace a hash by a value, relative jump past the default if found
 
 	// Compare
 	OpLt
@@ -95,15 +107,20 @@ type Instruction struct {
 	Op Opcode
 
 	// Operands for different instructions
-	Expr       Sexp          // For OpPush
+	Expr       Sexp          // For OpPush, OpUnpackKey
 	ClosedFunc *SexpFunction // For OpPushClosure
-	Sym        SexpSymbol    // For OpGet, OpPut, OpCall, OpPrepare
-	IsSet      bool          // For OpPut
-	Nargs      int           // For OpCall, OpPrepare, OpDispatch
-	Loc        int           // For OpJump, OpGoto, OpBranch
+	Sym        SexpSymbol    // For OpGet, OpPut, OpPutConst, OpGetLocal, OpPutLocal, OpCall, OpPrepare, OpTailCall, OpRequire
+	IsSet      bool          // For OpPut, OpPutLocal
+	Depth      int           // For OpGetLocal, OpPutLocal, the number of frames up
+	Slot       int           // For OpGetLocal, OpPutLocal
+	Frame      *Frame        // For OpAddScope
+	Nargs      int           // For OpCall, OpPrepare, OpDispatch, OpTailCall, OpTailDispatch, OpUnpackNth, OpUnpackRest
+	Cache      *callCache    // For OpCall, OpPrepare, OpTailCall, the inline cache of the callee
+	Loc        int           // For OpJump, OpGoto, OpBranch, OpTry, OpUnpackKey, OpRequire
 	Direction  bool          // For OpBranch
 	Err        error         // For OpReturn
 	DynamicErr bool          // For OpReturn
+	Pos        *Position     // Source position of the expression compiled into it
 }
 
 // InstrString provides a human-readable representation of the instruction.
@@ -121,8 +138,17 @@ func (i Instruction) InstrString() string {
 		return fmt.Sprintf("get %s", i.Sym.name)
 	case OpPut:
 		return fmt.Sprintf("put %s", i.Sym.name)
+	case OpGetLocal:
+		return fmt.Sprintf("get %s %d:%d", i.Sym.name, i.Depth, i.Slot)
+	case OpPutLocal:
+		if i.IsSet {
+			return fmt.Sprintf("set %s %d:%d", i.Sym.name, i.Depth, i.Slot)
+		}
+		return fmt.Sprintf("put %s %d", i.Sym.name, i.Slot)
 	case OpBindDynFun:
 		return "bind dynamic function"
+	case OpPutConst:
+		return fmt.Sprintf("putconst %s", i.Sym.name)
 	case OpJump:
 		return fmt.Sprintf("jump %d", i.Loc)
 	case OpGoto:
@@ -144,6 +170,18 @@ func (i Instruction) InstrString() string {
 		return fmt.Sprintf("preparecall %s %d", i.Sym.name, i.Nargs)
 	case OpDispatch:
 		return fmt.Sprintf("dispatch %d", i.Nargs)
+	case OpTailCall:
+		return fmt.Sprintf("tailcall %s %d", i.Sym.name, i.Nargs)
+	case OpTailDispatch:
+		return fmt.Sprintf("taildispatch %d", i.Nargs)
+	case OpTry:
+		return fmt.Sprintf("try %d", i.Loc)
+	case OpEndTry:
+		return "endtry"
+	case OpThrow:
+		return "throw"
+	case OpRequire:
+		return fmt.Sprintf("require %s %d", i.Sym.name, i.Loc)
 	case OpAddScope:
 		return "add scope"
 	case OpRemoveScope:
@@ -158,6 +196,12 @@ func (i Instruction) InstrString() string {
 		return "bindlist"
 	case OpRefSym:
 		return "ref symbol"
+	case OpUnpackNth:
+		return fmt.Sprintf("nth %d", i.Nargs)
+	case OpUnpackRest:
+		return fmt.Sprintf("nthrest %d", i.Nargs)
+	case OpUnpackKey:
+		return fmt.Sprintf("key %s %d", i.Expr.SexpString(), i.Loc)
 	case OpLt:
 		return "<"
 	case OpGt:
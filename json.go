@@ -3,6 +3,7 @@ package glisp
 import (
 	"bytes"
 	"encoding/json"
+	"strconv"
 )
 
 func Marshal(a Sexp) ([]byte, error) {
@@ -39,6 +40,9 @@ func Marshal(a Sexp) ([]byte, error) {
 }
 
 func (a SexpInt) MarshalJSON() ([]byte, error) {
+	if a.v == nil {
+		return strconv.AppendInt(nil, a.i, 10), nil
+	}
 	return a.v.MarshalText()
 }
 
@@ -42,6 +42,7 @@ const (
 type Token struct {
 	typ TokenType
 	str string
+	pos Position
 }
 
 func (t Token) String() string {
@@ -105,6 +106,9 @@ type Lexer struct {
 	buffer   *bytes.Buffer
 	stream   RuneReader
 	finished bool
+	file     string
+	// start is the position of the first rune in buffer
+	start Position
 }
 
 var (
@@ -194,38 +198,38 @@ func DecodeChar(atom string) (string, error) {
 
 func DecodeAtom(atom string) (Token, error) {
 	if atom == "." {
-		return Token{TokenDot, ""}, nil
+		return Token{typ: TokenDot}, nil
 	}
 	if BoolRegex.MatchString(atom) {
-		return Token{TokenBool, atom}, nil
+		return Token{typ: TokenBool, str: atom}, nil
 	}
 	if DecimalRegex.MatchString(atom) {
-		return Token{TokenDecimal, atom}, nil
+		return Token{typ: TokenDecimal, str: atom}, nil
 	}
 	if HexRegex.MatchString(atom) {
-		return Token{TokenHex, atom[2:]}, nil
+		return Token{typ: TokenHex, str: atom[2:]}, nil
 	}
 	if OctRegex.MatchString(atom) {
-		return Token{TokenOct, atom[2:]}, nil
+		return Token{typ: TokenOct, str: atom[2:]}, nil
 	}
 	if BinaryRegex.MatchString(atom) {
-		return Token{TokenBinary, atom[2:]}, nil
+		return Token{typ: TokenBinary, str: atom[2:]}, nil
 	}
 	if BinaryStreamRegex.MatchString(atom) {
-		return Token{TokenBinaryStream, atom[2:]}, nil
+		return Token{typ: TokenBinaryStream, str: atom[2:]}, nil
 	}
 	if FloatRegex.MatchString(atom) {
-		return Token{TokenFloat, atom}, nil
+		return Token{typ: TokenFloat, str: atom}, nil
 	}
 	if SymbolRegex.MatchString(atom) {
-		return Token{TokenSymbol, atom}, nil
+		return Token{typ: TokenSymbol, str: atom}, nil
 	}
 	if CharRegex.MatchString(atom) {
 		char, err := DecodeChar(atom)
 		if err != nil {
 			return Token{}, err
 		}
-		return Token{TokenChar, char}, nil
+		return Token{typ: TokenChar, str: char}, nil
 	}
 
 	return Token{}, fmt.Errorf("Unrecognized atom `%s`", atom)
@@ -242,32 +246,42 @@ func (lexer *Lexer) dumpBuffer() error {
 	}
 
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, tok)
+	lexer.emitAt(tok, lexer.start)
 	return nil
 }
 
 func (lexer *Lexer) dumpString() {
 	str := lexer.buffer.String()
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, Token{TokenString, str})
+	lexer.emitAt(Token{typ: TokenString, str: str}, lexer.start)
+}
+
+// emit appends a token found at the rune just read.
+func (lexer *Lexer) emit(tok Token) {
+	lexer.emitAt(tok, lexer.Position())
+}
+
+func (lexer *Lexer) emitAt(tok Token, pos Position) {
+	tok.pos = pos
+	lexer.tokens = append(lexer.tokens, tok)
 }
 
 func DecodeBrace(brace rune) Token {
 	switch brace {
 	case '(':
-		return Token{TokenLParen, ""}
+		return Token{typ: TokenLParen}
 	case ')':
-		return Token{TokenRParen, ""}
+		return Token{typ: TokenRParen}
 	case '[':
-		return Token{TokenLSquare, ""}
+		return Token{typ: TokenLSquare}
 	case ']':
-		return Token{TokenRSquare, ""}
+		return Token{typ: TokenRSquare}
 	case '{':
-		return Token{TokenLCurly, ""}
+		return Token{typ: TokenLCurly}
 	case '}':
-		return Token{TokenRCurly, ""}
+		return Token{typ: TokenRCurly}
 	}
-	return Token{TokenEnd, ""}
+	return Token{typ: TokenEnd}
 }
 
 func (lexer *Lexer) LexNextRune(r rune) error {
@@ -310,11 +324,9 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 	}
 	if lexer.state == LexerUnquote {
 		if r == '@' {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTildeAt, ""})
+			lexer.emit(Token{typ: TokenTildeAt})
 		} else {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTilde, ""})
+			lexer.emit(Token{typ: TokenTilde})
 			lexer.buffer.WriteRune(r)
 		}
 		lexer.state = LexerNormal
@@ -323,7 +335,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 	if lexer.state == LexerSharp {
 		if r == '\'' && lexer.buffer.Len() == 1 {
 			lexer.buffer.Reset()
-			lexer.tokens = append(lexer.tokens, Token{TokenSharpQuote, ""})
+			lexer.emit(Token{typ: TokenSharpQuote})
 			lexer.state = LexerNormal
 			return nil
 		} else if r == '`' && lexer.buffer.Len() == 1 {
@@ -341,7 +353,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 			/* lambda */
 			lexer.state = LexerNormal
 			lexer.buffer.Reset()
-			lexer.tokens = append(lexer.tokens, Token{TokenLambda, ""})
+			lexer.emit(Token{typ: TokenLambda})
 		}
 	}
 
@@ -367,7 +379,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected quote")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenQuote, ""})
+		lexer.emit(Token{typ: TokenQuote})
 		return nil
 	}
 
@@ -375,7 +387,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected backtick")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenBacktick, ""})
+		lexer.emit(Token{typ: TokenBacktick})
 		return nil
 	}
 
@@ -392,7 +404,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if err != nil {
 			return err
 		}
-		lexer.tokens = append(lexer.tokens, DecodeBrace(r))
+		lexer.emit(DecodeBrace(r))
 		return nil
 	}
 	if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
@@ -412,7 +424,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 
 func (lexer *Lexer) PeekNextToken() (Token, error) {
 	if lexer.finished {
-		return Token{TokenEnd, ""}, nil
+		return Token{typ: TokenEnd}, nil
 	}
 	for len(lexer.tokens) == 0 {
 		r, _, err := lexer.stream.ReadRune()
@@ -422,12 +434,15 @@ func (lexer *Lexer) PeekNextToken() (Token, error) {
 				lexer.dumpBuffer()
 				return lexer.tokens[0], nil
 			}
-			return Token{TokenEnd, ""}, nil
+			return Token{typ: TokenEnd}, nil
 		}
 
+		if lexer.state == LexerNormal && lexer.buffer.Len() == 0 {
+			lexer.start = lexer.Position()
+		}
 		err = lexer.LexNextRune(r)
 		if err != nil {
-			return Token{TokenEnd, ""}, err
+			return Token{typ: TokenEnd}, err
 		}
 	}
 
@@ -438,7 +453,7 @@ func (lexer *Lexer) PeekNextToken() (Token, error) {
 func (lexer *Lexer) GetNextToken() (Token, error) {
 	tok, err := lexer.PeekNextToken()
 	if err != nil || tok.typ == TokenEnd {
-		return Token{TokenEnd, ""}, err
+		return Token{typ: TokenEnd}, err
 	}
 	lexer.tokens = lexer.tokens[1:]
 	return tok, nil
@@ -464,6 +479,17 @@ func (lexer *Lexer) LineOffset() int {
 	return n
 }
 
+// SetFile sets the file name reported in the positions of tokens.
+func (lexer *Lexer) SetFile(file string) {
+	lexer.file = file
+}
+
+// Position returns the position of the rune read last.
+func (lexer *Lexer) Position() Position {
+	line, col := lexer.stream.Offset()
+	return Position{File: lexer.file, Line: line, Col: col}
+}
+
 func (lexer *Lexer) CurLine() string {
 	return lexer.stream.CurLine()
 }
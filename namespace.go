@@ -0,0 +1,478 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Namespaces are resolved at compile time. Top level definitions made after
+// (ns lib) are bound to qualified names like lib/name, and symbols are
+// rewritten to the names they refer to: a name defined in the current
+// namespace, alias/name for a namespace loaded by (require "path" :as
+// alias), or lib/name. Names made by defn- and def- are private, only the
+// code of their namespace and the expansions of its macros may use them.
+// Symbols no namespace defines, such as str/len, are left as they are.
+
+// namespace holds the names defined in a namespace and the aliases it
+// gave to the namespaces it requires. The default namespace has an empty
+// name and does not qualify its definitions.
+type namespace struct {
+	name string
+	// defs holds the names defined in the namespace, true if private
+	defs    map[string]bool
+	aliases map[string]string
+	// parent holds the names the namespace had in a parent environment,
+	// they are never changed through ns
+	parent *namespace
+}
+
+func newNamespace(name string) *namespace {
+	return &namespace{name: name, defs: make(map[string]bool), aliases: make(map[string]string)}
+}
+
+// child returns an empty namespace falling back to ns.
+func (ns *namespace) child() *namespace {
+	dup := newNamespace(ns.name)
+	dup.parent = ns
+	return dup
+}
+
+// clone copies the names of ns and of its parents.
+func (ns *namespace) clone() *namespace {
+	dup := newNamespace(ns.name)
+	for n := ns; n != nil; n = n.parent {
+		for k, v := range n.defs {
+			if _, ok := dup.defs[k]; !ok {
+				dup.defs[k] = v
+			}
+		}
+		for k, v := range n.aliases {
+			if _, ok := dup.aliases[k]; !ok {
+				dup.aliases[k] = v
+			}
+		}
+	}
+	return dup
+}
+
+// def reports whether name is defined in ns and if it is private.
+func (ns *namespace) def(name string) (private bool, ok bool) {
+	for n := ns; n != nil; n = n.parent {
+		if private, ok = n.defs[name]; ok {
+			return
+		}
+	}
+	return false, false
+}
+
+// alias returns the namespace called alias in ns.
+func (ns *namespace) alias(alias string) (string, bool) {
+	for n := ns; n != nil; n = n.parent {
+		if name, ok := n.aliases[alias]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// nsTable is the compile time state of the namespaces of an environment,
+// shared by the environments duplicated from it. The table of a child
+// environment starts empty and falls back to the table of its parent.
+type nsTable struct {
+	current *namespace
+	byName  map[string]*namespace
+	// modules maps the files loaded by require to their code
+	modules map[string]*requiredModule
+	// compiling holds the modules being compiled, so modules requiring
+	// each other are compiled once
+	compiling map[string]bool
+	// expanding is the namespace of the macro being expanded
+	expanding *namespace
+	// resolved holds the files found by include, require and source-file
+	resolved []Module
+	// parent holds the namespaces of a parent environment, they are never
+	// changed through the table
+	parent *nsTable
+}
+
+func newNsTable() *nsTable {
+	return &nsTable{
+		current:   newNamespace(""),
+		byName:    make(map[string]*namespace),
+		modules:   make(map[string]*requiredModule),
+		compiling: make(map[string]bool),
+	}
+}
+
+// child returns an empty table falling back to t, its current namespace
+// is that of t.
+func (t *nsTable) child() *nsTable {
+	dup := newNsTable()
+	dup.parent = t
+	dup.current = t.current.child()
+	if t.current.name != "" {
+		dup.byName[t.current.name] = dup.current
+	}
+	return dup
+}
+
+// clone copies the namespaces of t and of its parents.
+func (t *nsTable) clone() *nsTable {
+	dup := newNsTable()
+	dup.current = t.current.clone()
+	for p := t; p != nil; p = p.parent {
+		for name, ns := range p.byName {
+			if _, ok := dup.byName[name]; ok {
+				continue
+			}
+			if name == t.current.name {
+				dup.byName[name] = dup.current
+			} else {
+				dup.byName[name] = ns.clone()
+			}
+		}
+	}
+	for p := t; p != nil; p = p.parent {
+		for file, m := range p.modules {
+			if _, ok := dup.modules[file]; !ok {
+				dup.modules[file] = &requiredModule{ns: dup.byName[m.ns.name], code: m.code}
+			}
+		}
+	}
+	dup.resolved = t.modulesFound()
+	return dup
+}
+
+// namespace returns the namespace called name.
+func (t *nsTable) namespace(name string) *namespace {
+	for p := t; p != nil; p = p.parent {
+		if ns, ok := p.byName[name]; ok {
+			return ns
+		}
+	}
+	return nil
+}
+
+// module returns the module loaded from the file at loc.
+func (t *nsTable) module(loc string) (*requiredModule, bool) {
+	for p := t; p != nil; p = p.parent {
+		if m, ok := p.modules[loc]; ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// requiredModule is a file loaded by require, it is compiled once and its
+// code is copied to each require.
+type requiredModule struct {
+	ns *namespace
+	// code runs the module unless it already ran
+	code []Instruction
+}
+
+// modulesFound returns the files found by t and its parents, in the order
+// they were first found.
+func (t *nsTable) modulesFound() []Module {
+	var found []Module
+	if t.parent != nil {
+		found = t.parent.modulesFound()
+	}
+	return append(found, t.resolved...)
+}
+
+func (t *nsTable) addModule(m Module) {
+	for p := t; p != nil; p = p.parent {
+		for _, r := range p.resolved {
+			if r.Path == m.Path {
+				return
+			}
+		}
+	}
+	t.resolved = append(t.resolved, m)
+}
+
+// enter makes the namespace called name current, creating it if needed.
+func (t *nsTable) enter(name string) *namespace {
+	ns, ok := t.byName[name]
+	if !ok {
+		if ns = t.namespace(name); ns != nil {
+			ns = ns.child()
+		} else {
+			ns = newNamespace(name)
+		}
+		t.byName[name] = ns
+	}
+	t.current = ns
+	return ns
+}
+
+// splitQualified splits lib/name, ok is false for names without a
+// namespace such as / itself.
+func splitQualified(name string) (prefix, rest string, ok bool) {
+	i := strings.IndexByte(name, '/')
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// lookup returns the namespace a qualified name refers to through an alias
+// of the current namespace or the name of the namespace.
+func (t *nsTable) lookup(prefix string) *namespace {
+	if name, ok := t.current.alias(prefix); ok {
+		return t.namespace(name)
+	}
+	return t.namespace(prefix)
+}
+
+// qualify returns the global name sym refers to from the current
+// namespace.
+func (t *nsTable) qualify(env *Environment, sym SexpSymbol) (SexpSymbol, error) {
+	prefix, name, ok := splitQualified(sym.name)
+	if !ok {
+		if t.current.name != "" {
+			if _, ok := t.current.def(sym.name); ok {
+				return env.MakeSymbol(t.current.name + "/" + sym.name), nil
+			}
+		}
+		return sym, nil
+	}
+	ns := t.lookup(prefix)
+	if ns == nil {
+		return sym, nil
+	}
+	if private, _ := ns.def(name); private && ns.name != t.current.name && (t.expanding == nil || ns.name != t.expanding.name) {
+		return sym, fmt.Errorf("%s is private to namespace %s", name, ns.name)
+	}
+	return env.MakeSymbol(ns.name + "/" + name), nil
+}
+
+// owner returns the namespace that defined the qualified name sym.
+func (t *nsTable) owner(sym SexpSymbol) *namespace {
+	prefix, name, ok := splitQualified(sym.name)
+	if !ok {
+		return nil
+	}
+	if ns := t.namespace(prefix); ns != nil {
+		if _, ok := ns.def(name); ok {
+			return ns
+		}
+	}
+	return nil
+}
+
+// define records sym as defined in the current namespace and returns the
+// name it is bound to.
+func (t *nsTable) define(env *Environment, sym SexpSymbol, private bool) SexpSymbol {
+	if t.current.name == "" {
+		return sym
+	}
+	if _, _, ok := splitQualified(sym.name); ok {
+		return sym
+	}
+	t.current.defs[sym.name] = private
+	return env.MakeSymbol(t.current.name + "/" + sym.name)
+}
+
+// declares returns the namespace expressions declare with ns, or an
+// empty string.
+func declares(expressions []Sexp) string {
+	for _, expr := range expressions {
+		if name, ok := nsDeclaration(expr); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func nsDeclaration(expr Sexp) (string, bool) {
+	list, ok := expr.(*SexpPair)
+	if !ok || !isSymbolNamed(list.head, "ns") {
+		return "", false
+	}
+	if tail, ok := list.tail.(*SexpPair); ok {
+		if sym, ok := tail.head.(SexpSymbol); ok {
+			return sym.name, true
+		}
+	}
+	return "", false
+}
+
+// prescan records the top level definitions of expressions in their
+// namespace before they are compiled, so the code before a definition
+// may refer to it.
+func (t *nsTable) prescan(expressions []Sexp) {
+	current := t.current
+	defer func() { t.current = current }()
+	for _, expr := range expressions {
+		if name, ok := nsDeclaration(expr); ok {
+			t.enter(name)
+			continue
+		}
+		list, ok := expr.(*SexpPair)
+		if !ok {
+			continue
+		}
+		head, ok := list.head.(SexpSymbol)
+		if !ok {
+			continue
+		}
+		private := false
+		switch head.name {
+		case "def-", "defn-":
+			private = true
+		case "def", "defn", "defconst", "defmac":
+		default:
+			continue
+		}
+		if tail, ok := list.tail.(*SexpPair); ok {
+			if sym, ok := tail.head.(SexpSymbol); ok && t.current.name != "" {
+				if _, _, ok := splitQualified(sym.name); !ok {
+					t.current.defs[sym.name] = private
+				}
+			}
+		}
+	}
+}
+
+// qualify resolves sym in the current namespace, local variables are left
+// as they are.
+func (gen *Generator) qualify(sym SexpSymbol) (SexpSymbol, error) {
+	if _, _, ok := gen.resolve(sym); ok {
+		return sym, nil
+	}
+	return gen.env.namespaces.qualify(gen.env, sym)
+}
+
+// define returns the name a definition of sym binds, qualified at the top
+// level of a namespace.
+func (gen *Generator) define(sym SexpSymbol, private bool) SexpSymbol {
+	if gen.scope != nil {
+		return sym
+	}
+	return gen.env.namespaces.define(gen.env, sym, private)
+}
+
+// GenerateNs compiles (ns name), which makes the code compiled after it
+// define its names in the namespace name.
+func (gen *Generator) GenerateNs(args []Sexp) error {
+	if len(args) != 1 {
+		return WrongGeneratorNumberArguments("ns", len(args), 1)
+	}
+	sym, ok := args[0].(SexpSymbol)
+	if !ok {
+		return fmt.Errorf("namespace name must be a symbol but got %s", InspectType(args[0]))
+	}
+	if _, _, ok := splitQualified(sym.name); ok {
+		return fmt.Errorf("namespace name %s must not contain /", sym.name)
+	}
+	if gen.scope != nil {
+		return errors.New("ns must be at the top level")
+	}
+	gen.env.namespaces.enter(sym.name)
+	gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
+	return nil
+}
+
+// GenerateRequire compiles (require "path" :as alias). The module at path
+// must declare its namespace, it is compiled in place and runs the first
+// time one of its requires does. Its names are then reachable as
+// alias/name.
+func (gen *Generator) GenerateRequire(args []Sexp) error {
+	if len(args) != 1 && len(args) != 3 {
+		return errors.New("require expects a path and an optional :as alias")
+	}
+	path, ok := args[0].(SexpStr)
+	if !ok {
+		return fmt.Errorf("require: module path must be a string but got %s", InspectType(args[0]))
+	}
+	var alias string
+	if len(args) == 3 {
+		sym, ok := args[2].(SexpSymbol)
+		if !isSymbolNamed(args[1], ":as") || !ok {
+			return errors.New("require expects a path and an optional :as alias")
+		}
+		alias = sym.name
+	}
+
+	ns, err := gen.loadModule(string(path))
+	if err != nil {
+		return err
+	}
+	if alias != "" {
+		gen.env.namespaces.current.aliases[alias] = ns.name
+	}
+	gen.AddInstruction(Instruction{Op: OpPush, Expr: SexpNull})
+	return nil
+}
+
+// loadModule compiles the module at path the first time it is required,
+// adds its code and returns its namespace. The code of the module is
+// skipped once a require ran it, it binds a global telling so after its
+// last expression.
+func (gen *Generator) loadModule(path string) (*namespace, error) {
+	table := gen.env.namespaces
+	in, src, err := gen.env.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	loc := location(src.reader, src.file)
+	if m, ok := table.module(loc); ok {
+		if !table.compiling[loc] {
+			gen.addModuleCode(m.code)
+		}
+		return m.ns, nil
+	}
+	exps, err := gen.env.parseNamedStream(in, loc)
+	if err != nil {
+		return nil, err
+	}
+	defer gen.env.loadingFile(src)()
+	name := declares(exps)
+	if name == "" {
+		return nil, fmt.Errorf("require: %s does not declare a namespace", path)
+	}
+
+	current := table.current
+	defer func() { table.current = current }()
+	ns := table.enter(name)
+	table.current = current
+	m := &requiredModule{ns: ns}
+	table.modules[loc] = m
+	table.compiling[loc] = true
+	defer delete(table.compiling, loc)
+
+	subgen := gen.subGenerator()
+	subgen.scopes = gen.scopes
+	if err := subgen.GenerateBegin(exps); err != nil {
+		delete(table.modules, loc)
+		return nil, err
+	}
+	loaded := gen.env.MakeSymbol("module " + loc)
+	m.code = append(m.code, Instruction{Op: OpRequire, Sym: loaded, Loc: len(subgen.instructions) + 4})
+	m.code = append(m.code, subgen.instructions...)
+	m.code = append(m.code,
+		Instruction{Op: OpPop},
+		Instruction{Op: OpPush, Expr: SexpBool(true)},
+		Instruction{Op: OpPutConst, Sym: loaded})
+	gen.addModuleCode(m.code)
+	return ns, nil
+}
+
+// addModuleCode adds a copy of the code of a module with call caches of
+// its own.
+func (gen *Generator) addModuleCode(code []Instruction) {
+	for _, instr := range code {
+		instr.Cache = nil
+		gen.AddInstruction(instr)
+	}
+}
+
+// moduleLoaded reports whether the module whose global is sym has run.
+func (env *Environment) moduleLoaded(sym SexpSymbol) bool {
+	_, err := lookupFrom(env.scopestack.bottom, sym)
+	return err == nil
+}
@@ -0,0 +1,193 @@
+package glisp
+
+// SetOptimizer turns the optimization of generated code on or off, it is on
+// by default. Turning it off helps to compare outputs while debugging.
+func (env *Environment) SetOptimizer(enabled bool) {
+	env.noOptimize = !enabled
+}
+
+// code returns the generated instructions, optimized unless the optimizer
+// is turned off.
+func (gen *Generator) code() []Instruction {
+	if gen.env.noOptimize {
+		return gen.instructions
+	}
+	return optimize(gen.instructions)
+}
+
+// optimize rewrites the instructions of a function until nothing changes:
+// constant arithmetic and comparisons are folded, jumps to jumps are
+// threaded, and pushes popped right away as well as empty scopes are
+// removed. Jumps are fixed up for the removed instructions.
+func optimize(code []Instruction) []Instruction {
+	for {
+		removed := make([]bool, len(code))
+		changed := threadJumps(code, removed)
+		targets := jumpTargets(code)
+		changed = foldConstants(code, targets, removed) || changed
+		changed = removePairs(code, targets, removed) || changed
+		if !changed {
+			return code
+		}
+		code = compact(code, removed)
+	}
+}
+
+// jumpTarget returns the index instruction i may continue at other than
+// the next one.
+func jumpTarget(code []Instruction, i int) (int, bool) {
+	switch code[i].Op {
+	case OpJump, OpBranch, OpTry, OpUnpackKey, OpRequire:
+		return i + code[i].Loc, true
+	case OpGoto:
+		return code[i].Loc, true
+	}
+	return 0, false
+}
+
+func jumpTargets(code []Instruction) []bool {
+	targets := make([]bool, len(code)+1)
+	for i := range code {
+		if t, ok := jumpTarget(code, i); ok && t >= 0 && t <= len(code) {
+			targets[t] = true
+		}
+	}
+	return targets
+}
+
+// threadJumps lets jumps and branches landing on a jump go to its target
+// directly, and removes jumps to the next instruction.
+func threadJumps(code []Instruction, removed []bool) bool {
+	var changed bool
+	for i := range code {
+		if code[i].Op != OpJump && code[i].Op != OpBranch {
+			continue
+		}
+		t := i + code[i].Loc
+		// the step limit stops at jumps going round in circles
+		for steps := 0; steps < len(code) && t >= 0 && t < len(code) && code[t].Op == OpJump && code[t].Loc != 0; steps++ {
+			t += code[t].Loc
+		}
+		if t-i != code[i].Loc {
+			code[i].Loc = t - i
+			changed = true
+		}
+		if code[i].Op == OpJump && code[i].Loc == 1 {
+			removed[i] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+var foldableOps = map[Opcode]string{
+	OpArithAdd: "+",
+	OpArithSub: "-",
+	OpArithMul: "*",
+	OpArithDiv: "/",
+	OpLt:       "<",
+	OpGt:       ">",
+	OpLEt:      "<=",
+	OpGEt:      ">=",
+	OpEq:       "=",
+	OpNotEq:    "!=",
+}
+
+// foldConstants replaces arithmetic and comparisons of numbers pushed right
+// before them by their result. Operations failing on their constants are
+// left to fail at run time.
+func foldConstants(code []Instruction, targets []bool, removed []bool) bool {
+	var changed bool
+	for i := range code {
+		name, ok := foldableOps[code[i].Op]
+		nargs := code[i].Nargs
+		if !ok || nargs < 2 || nargs > i {
+			continue
+		}
+		args := make([]Sexp, 0, nargs)
+		for j := i - nargs; j < i; j++ {
+			// jumps into the sequence would skip some pushes
+			if removed[j] || targets[j+1] || code[j].Op != OpPush || !isNumber(code[j].Expr) {
+				break
+			}
+			args = append(args, code[j].Expr)
+		}
+		if len(args) != nargs {
+			continue
+		}
+		var res Sexp
+		var err error
+		if code[i].Op >= OpArithAdd && code[i].Op <= OpArithDiv {
+			res, err = simpleArithmetic(name, MakeArgs(args...))
+		} else {
+			var cond bool
+			cond, err = compareArgs(name, MakeArgs(args...))
+			res = SexpBool(cond)
+		}
+		if err != nil {
+			continue
+		}
+		for j := i - nargs; j < i; j++ {
+			removed[j] = true
+		}
+		code[i] = Instruction{Op: OpPush, Expr: res, Pos: code[i].Pos}
+		changed = true
+	}
+	return changed
+}
+
+func isNumber(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpInt, SexpFloat:
+		return true
+	}
+	return false
+}
+
+// removePairs removes pushes followed by a pop and scopes removed right
+// after they are added, unless a jump lands between the two.
+func removePairs(code []Instruction, targets []bool, removed []bool) bool {
+	var changed bool
+	for i := 0; i+1 < len(code); i++ {
+		if removed[i] || removed[i+1] || targets[i+1] {
+			continue
+		}
+		if code[i].Op == OpPush && code[i+1].Op == OpPop ||
+			code[i].Op == OpAddScope && code[i+1].Op == OpRemoveScope {
+			removed[i], removed[i+1] = true, true
+			changed = true
+			i++
+		}
+	}
+	return changed
+}
+
+// compact drops the removed instructions, jumps to a removed instruction
+// continue at the next one kept.
+func compact(code []Instruction, removed []bool) []Instruction {
+	index := make([]int, len(code)+1)
+	n := 0
+	for i := range code {
+		index[i] = n
+		if !removed[i] {
+			n++
+		}
+	}
+	index[len(code)] = n
+
+	ret := make([]Instruction, 0, n)
+	for i, instr := range code {
+		if removed[i] {
+			continue
+		}
+		if t, ok := jumpTarget(code, i); ok && t >= 0 && t <= len(code) {
+			if instr.Op == OpGoto {
+				instr.Loc = index[t]
+			} else {
+				instr.Loc = index[t] - index[i]
+			}
+		}
+		ret = append(ret, instr)
+	}
+	return ret
+}
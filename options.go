@@ -0,0 +1,97 @@
+package glisp
+
+import "fmt"
+
+// EnvOption configures an environment created by NewWithOptions.
+type EnvOption func(*stackLimits)
+
+// stackLimits holds the initial sizes and the maximums of the stacks of an
+// environment, a zero maximum means no limit.
+type stackLimits struct {
+	dataSize, dataMax   int
+	callSize, callMax   int
+	scopeMax            int
+	stackSize, stackMax int
+}
+
+func defaultStackLimits() stackLimits {
+	return stackLimits{
+		dataSize:  DataStackSize,
+		callSize:  CallStackSize,
+		stackSize: StackStackSize,
+	}
+}
+
+// WithDataStack sets the initial size and the maximum of the stack holding
+// arguments and intermediate values.
+func WithDataStack(size, max int) EnvOption {
+	return func(l *stackLimits) {
+		l.dataSize, l.dataMax = size, max
+	}
+}
+
+// WithCallStack sets the initial size and the maximum of the stack of
+// return addresses, that is the number of nested function calls.
+func WithCallStack(size, max int) EnvOption {
+	return func(l *stackLimits) {
+		l.callSize, l.callMax = size, max
+	}
+}
+
+// WithScopeStack sets the maximum number of nested scopes visible to a
+// function, counting the global scope, let scopes and the scopes captured
+// by closures. Scopes are linked rather than preallocated, so there is no
+// initial size.
+func WithScopeStack(max int) EnvOption {
+	return func(l *stackLimits) {
+		l.scopeMax = max
+	}
+}
+
+// WithStackStack sets the initial size and the maximum of the stack saving
+// the scopes of the callers of glisp functions.
+func WithStackStack(size, max int) EnvOption {
+	return func(l *stackLimits) {
+		l.stackSize, l.stackMax = size, max
+	}
+}
+
+// StackOverflowError is returned when calling Function would grow Stack
+// beyond the maximum set by NewWithOptions. Stack is one of "data", "call",
+// "scope" and "stack".
+type StackOverflowError struct {
+	Stack    string
+	Function string
+	Limit    int
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("%s stack overflow calling %s: limit of %d exceeded", e.Stack, e.Function, e.Limit)
+}
+
+// checkCall returns a StackOverflowError if calling function pushes the
+// call stack or the data stack beyond their maximums. Calls saving the scope
+// of the caller push the stack stack too.
+func (env *Environment) checkCall(function string, saveScope bool) error {
+	l := &env.limits
+	if l.callMax > 0 && env.addrstack.Top()+1 >= l.callMax {
+		return &StackOverflowError{Stack: "call", Function: function, Limit: l.callMax}
+	}
+	if saveScope && l.stackMax > 0 && env.stackstack.Top()+1 >= l.stackMax {
+		return &StackOverflowError{Stack: "stack", Function: function, Limit: l.stackMax}
+	}
+	// the data stack grows between calls, it is checked at the next one
+	if l.dataMax > 0 && env.datastack.Top()+1 > l.dataMax {
+		return &StackOverflowError{Stack: "data", Function: function, Limit: l.dataMax}
+	}
+	return nil
+}
+
+// checkScope returns a StackOverflowError if a scope stack of depth layers
+// is beyond the maximum.
+func (env *Environment) checkScope(function string, depth int) error {
+	if max := env.limits.scopeMax; max > 0 && depth > max {
+		return &StackOverflowError{Stack: "scope", Function: function, Limit: max}
+	}
+	return nil
+}
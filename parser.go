@@ -151,11 +151,21 @@ func ParseExpression(parser *Parser) (Sexp, error) {
 
 	switch tok.typ {
 	case TokenLParen:
-		return ParseList(parser)
+		expr, err := ParseList(parser)
+		if pair, ok := expr.(*SexpPair); ok && err == nil {
+			pos := tok.pos
+			pair.pos = &pos
+		}
+		return expr, err
 	case TokenLSquare:
 		return ParseArray(parser)
 	case TokenLCurly:
-		return ParseHash(parser)
+		expr, err := ParseHash(parser)
+		if pair, ok := expr.(*SexpPair); ok && err == nil {
+			pos := tok.pos
+			pair.pos = &pos
+		}
+		return expr, err
 	case TokenQuote:
 		expr, err := ParseExpression(parser)
 		if err != nil {
@@ -0,0 +1,37 @@
+package glisp
+
+import "fmt"
+
+// Position is a location in the source code, Line and Col start at 1.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// IsValid reports whether the position refers to a real source location.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// CompileError is returned when an expression cannot be compiled, Pos is
+// the position of the innermost list that failed.
+type CompileError struct {
+	Err error
+	Pos Position
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Pos, e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
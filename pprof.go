@@ -0,0 +1,151 @@
+package glisp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+// WriteProfile writes the recorded calls to w as a gzipped pprof profile,
+// which can be opened with go tool pprof. Every sample is a call stack with
+// the number of calls and the self time of its innermost function.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	strs := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		strs[s] = int64(len(table))
+		table = append(table, s)
+		return strs[s]
+	}
+
+	var prof protoBuffer
+	for _, vt := range [][2]string{{"calls", "count"}, {"time", "nanoseconds"}} {
+		var m protoBuffer
+		m.intField(1, str(vt[0]))
+		m.intField(2, str(vt[1]))
+		prof.messageField(1, &m)
+	}
+
+	// functions and locations share their ids, one location per function
+	names := make([]string, 0, len(p.funcs))
+	for name := range p.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := make(map[string]uint64)
+	for i, name := range names {
+		ids[name] = uint64(i + 1)
+	}
+
+	var walk func(node *profNode, stack []uint64)
+	walk = func(node *profNode, stack []uint64) {
+		children := make([]string, 0, len(node.children))
+		for name := range node.children {
+			children = append(children, name)
+		}
+		sort.Strings(children)
+		for _, name := range children {
+			child := node.children[name]
+			// pprof lists the innermost location first
+			cstack := append([]uint64{ids[name]}, stack...)
+			var m protoBuffer
+			m.packedField(1, cstack)
+			m.packedField(2, []uint64{uint64(child.calls), uint64(child.self)})
+			prof.messageField(2, &m)
+			walk(child, cstack)
+		}
+	}
+	walk(p.root, nil)
+
+	for _, name := range names {
+		var line protoBuffer
+		line.uintField(1, ids[name])
+		line.intField(2, int64(p.sources[name].Line))
+		var loc protoBuffer
+		loc.uintField(1, ids[name])
+		loc.messageField(4, &line)
+		prof.messageField(4, &loc)
+	}
+	for _, name := range names {
+		var fn protoBuffer
+		fn.uintField(1, ids[name])
+		fn.intField(2, str(name))
+		fn.intField(3, str(name))
+		fn.intField(4, str(p.sources[name].File))
+		fn.intField(5, int64(p.sources[name].Line))
+		prof.messageField(5, &fn)
+	}
+
+	var period protoBuffer
+	period.intField(1, str("calls"))
+	period.intField(2, str("count"))
+
+	for _, s := range table {
+		prof.stringField(6, s)
+	}
+	prof.intField(9, p.start.UnixNano())
+	prof.intField(10, int64(time.Since(p.start)))
+	prof.messageField(11, &period)
+	prof.intField(12, 1)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(prof.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuffer encodes the subset of the protocol buffer wire format used by
+// the pprof profile.proto messages.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) uintField(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) intField(field int, x int64) {
+	b.uintField(field, uint64(x))
+}
+
+// stringField always writes s, the string table must keep empty strings.
+func (b *protoBuffer) stringField(field int, s string) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protoBuffer) messageField(field int, m *protoBuffer) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
+
+func (b *protoBuffer) packedField(field int, xs []uint64) {
+	var m protoBuffer
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.messageField(field, &m)
+}
@@ -0,0 +1,160 @@
+package glisp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Profiler records how often each function is called and how much time is
+// spent in it. Attach it with AttachProfiler, calls are only measured while
+// it is attached. A Profiler must not be shared by environments running
+// concurrently.
+type Profiler struct {
+	mu     sync.Mutex
+	start  time.Time
+	root   *profNode
+	frames []profFrame
+	funcs  map[string]*FuncProfile
+	// active counts the running calls of each function so recursive calls
+	// add to Cum only once
+	active  map[string]int
+	sources map[string]Position
+}
+
+// FuncProfile is the profile of a single function. Self is the time spent
+// in the function itself, Cum includes the functions it called.
+type FuncProfile struct {
+	Name  string
+	Calls int64
+	Self  time.Duration
+	Cum   time.Duration
+}
+
+// profNode is a node of the call tree, the path from the root is the call
+// stack that reached it.
+type profNode struct {
+	name     string
+	parent   *profNode
+	children map[string]*profNode
+	calls    int64
+	self     time.Duration
+}
+
+type profFrame struct {
+	node  *profNode
+	start time.Time
+	child time.Duration
+	// depth is the top of the address stack while the call runs
+	depth int
+}
+
+func NewProfiler() *Profiler {
+	p := new(Profiler)
+	p.Reset()
+	return p
+}
+
+// Reset discards everything recorded so far.
+func (p *Profiler) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start = time.Now()
+	p.root = &profNode{}
+	p.frames = nil
+	p.funcs = make(map[string]*FuncProfile)
+	p.active = make(map[string]int)
+	p.sources = make(map[string]Position)
+}
+
+// AttachProfiler makes Run record the calls of env in p, nil detaches the
+// profiler. Environments created by Clone share it.
+func (env *Environment) AttachProfiler(p *Profiler) {
+	env.profiler = p
+}
+
+// Profiler returns the attached profiler or nil.
+func (env *Environment) Profiler() *Profiler {
+	return env.profiler
+}
+
+// Functions returns the profile of every function called so far, the most
+// expensive first.
+func (p *Profiler) Functions() []FuncProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make([]FuncProfile, 0, len(p.funcs))
+	for _, fp := range p.funcs {
+		ret = append(ret, *fp)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Cum != ret[j].Cum {
+			return ret[i].Cum > ret[j].Cum
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (p *Profiler) enter(function *SexpFunction, name string, depth int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	parent := p.root
+	if n := len(p.frames); n > 0 {
+		parent = p.frames[n-1].node
+	}
+	node, ok := parent.children[name]
+	if !ok {
+		node = &profNode{name: name, parent: parent}
+		if parent.children == nil {
+			parent.children = make(map[string]*profNode)
+		}
+		parent.children[name] = node
+	}
+	node.calls++
+
+	fp, ok := p.funcs[name]
+	if !ok {
+		fp = &FuncProfile{Name: name}
+		p.funcs[name] = fp
+		p.sources[name] = functionPosition(function)
+	}
+	fp.Calls++
+	p.active[name]++
+	p.frames = append(p.frames, profFrame{node: node, start: time.Now(), depth: depth})
+}
+
+// leave ends the calls running above the address stack top depth, calls
+// abandoned by an error end together with the call that unwinds them.
+func (p *Profiler) leave(depth int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for n := len(p.frames); n > 0 && p.frames[n-1].depth > depth; n-- {
+		frame := p.frames[n-1]
+		total := now.Sub(frame.start)
+		frame.node.self += total - frame.child
+
+		name := frame.node.name
+		fp := p.funcs[name]
+		fp.Self += total - frame.child
+		if p.active[name]--; p.active[name] == 0 {
+			fp.Cum += total
+		}
+		if n > 1 {
+			p.frames[n-2].child += total
+		}
+		p.frames = p.frames[:n-1]
+	}
+}
+
+// functionPosition returns the position of the first expression of a
+// script function.
+func functionPosition(function *SexpFunction) Position {
+	for _, instr := range function.fun {
+		if instr.Pos != nil {
+			return *instr.Pos
+		}
+	}
+	return Position{}
+}
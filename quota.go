@@ -0,0 +1,137 @@
+package glisp
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// AllocKind is the kind of value checked against an AllocQuota.
+type AllocKind int
+
+const (
+	AllocString AllocKind = iota
+	AllocArray
+	AllocHash
+	AllocBytes
+)
+
+func (k AllocKind) String() string {
+	switch k {
+	case AllocString:
+		return "string"
+	case AllocArray:
+		return "array"
+	case AllocHash:
+		return "hash"
+	case AllocBytes:
+		return "bytes"
+	}
+	return "unknown"
+}
+
+// AllocQuota limits the size of values builtins may create. Strings and
+// bytes are measured in bytes, arrays and lists in elements, hashes in
+// entries. A zero field means no limit.
+type AllocQuota struct {
+	MaxStringLen int
+	MaxArrayLen  int
+	MaxHashLen   int
+	MaxBytesLen  int
+}
+
+func (q *AllocQuota) limit(kind AllocKind) int {
+	switch kind {
+	case AllocString:
+		return q.MaxStringLen
+	case AllocArray:
+		return q.MaxArrayLen
+	case AllocHash:
+		return q.MaxHashLen
+	case AllocBytes:
+		return q.MaxBytesLen
+	}
+	return 0
+}
+
+// QuotaExceededError is returned when a builtin would create a value larger
+// than the quota set by SetAllocQuota.
+type QuotaExceededError struct {
+	Kind  AllocKind
+	Size  int
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s of size %d exceeds allocation quota of %d", e.Kind, e.Size, e.Limit)
+}
+
+// sharedQuota holds the quota of an environment and the environments
+// duplicated from it, coroutines read it while SetAllocQuota replaces it.
+type sharedQuota struct {
+	q atomic.Pointer[AllocQuota]
+}
+
+func newSharedQuota(q AllocQuota) *sharedQuota {
+	s := &sharedQuota{}
+	s.store(q)
+	return s
+}
+
+func (s *sharedQuota) load() *AllocQuota { return s.q.Load() }
+
+func (s *sharedQuota) store(q AllocQuota) { s.q.Store(&q) }
+
+// SetAllocQuota limits the size of values created by builtins from now on.
+// The quota is shared with environments created by Duplicate, coroutines
+// running with them see the new quota.
+func (env *Environment) SetAllocQuota(q AllocQuota) {
+	env.quota.store(q)
+}
+
+// AllocQuota returns the current allocation quota.
+func (env *Environment) AllocQuota() AllocQuota {
+	return *env.quota.load()
+}
+
+// CheckAlloc returns a QuotaExceededError if a value of kind with size
+// elements is not allowed by the quota. Extensions should call it before
+// allocating large values.
+func (env *Environment) CheckAlloc(kind AllocKind, size int) error {
+	if limit := env.quota.load().limit(kind); limit > 0 && size > limit {
+		return &QuotaExceededError{Kind: kind, Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// CheckAllocOf checks the size of an already built value against the quota,
+// values other than strings, arrays, lists, hashes and bytes always pass.
+func (env *Environment) CheckAllocOf(expr Sexp) error {
+	switch t := expr.(type) {
+	case SexpStr:
+		return env.CheckAlloc(AllocString, len(t))
+	case SexpArray:
+		return env.CheckAlloc(AllocArray, len(t))
+	case *SexpHash:
+		return env.CheckAlloc(AllocHash, len(t.Map))
+	case SexpBytes:
+		return env.CheckAlloc(AllocBytes, len(t.bytes))
+	case *SexpPair:
+		if env.quota.load().MaxArrayLen <= 0 {
+			return nil
+		}
+		n, _ := getLenFunction(t)
+		return env.CheckAlloc(AllocArray, n)
+	}
+	return nil
+}
+
+func (env *Environment) checkHashSet(args Args) error {
+	if args.Len() != 3 || env.quota.load().MaxHashLen <= 0 {
+		return nil
+	}
+	hash, ok := args.Get(0).(*SexpHash)
+	if !ok || hash.HashExist(args.Get(1)) {
+		return nil
+	}
+	return env.CheckAlloc(AllocHash, len(hash.Map)+1)
+}
@@ -0,0 +1,157 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qjpcpu/glisp"
+)
+
+const debugHelp = `debugger commands:
+  :break NAME|LINE|FILE:LINE  set a breakpoint, without argument list them
+  :clear                      remove all breakpoints
+  :step :next :out            step into, over or out of the current function
+  :continue                   run until the next breakpoint
+  :abort                      stop the evaluation
+  :locals :stack :bt          show local bindings, data stack or call stack
+  :help                       show this help`
+
+// replDebugger hands the pauses of the evaluation goroutine over to the
+// command loop and waits for the command that resumes it.
+type replDebugger struct {
+	*glisp.Debugger
+	paused  chan *glisp.Pause
+	resume  chan glisp.DebugAction
+	current *glisp.Pause
+	// interactive is set once the command loop runs, before that (debug)
+	// has nobody to hand the pause to
+	interactive bool
+}
+
+func newReplDebugger() *replDebugger {
+	d := &replDebugger{
+		paused: make(chan *glisp.Pause),
+		resume: make(chan glisp.DebugAction),
+	}
+	d.Debugger = glisp.NewDebugger(func(p *glisp.Pause) glisp.DebugAction {
+		d.paused <- p
+		return <-d.resume
+	})
+	return d
+}
+
+// attach is called before each evaluation, the debugger stays detached
+// while there are no breakpoints so evaluation runs at full speed.
+func (d *replDebugger) attach(env *glisp.Environment) {
+	if len(d.Breakpoints()) > 0 {
+		env.AttachDebugger(d.Debugger)
+	} else {
+		env.AttachDebugger(nil)
+	}
+}
+
+// debugFunction implements (debug), pausing the evaluation at the next
+// expression.
+func (d *replDebugger) debugFunction(name string) glisp.UserFunction {
+	return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+		if args.Len() != 0 {
+			return glisp.WrongNumberArguments(name, args.Len(), 0)
+		}
+		if d.interactive {
+			env.AttachDebugger(d.Debugger)
+			d.Break()
+		}
+		return glisp.SexpNull, nil
+	}
+}
+
+func (d *replDebugger) pause(p *glisp.Pause) {
+	d.current = p
+	fmt.Printf("paused in %s", p.Function)
+	if p.Pos.IsValid() {
+		fmt.Printf(" at %s", p.Pos)
+	}
+	fmt.Printf(" (%s)\n", p.Reason)
+}
+
+func isDebugCommand(line string) bool {
+	switch strings.Fields(line + " ")[0] {
+	case ":break", ":clear", ":step", ":next", ":out", ":continue", ":abort", ":locals", ":stack", ":bt", ":help":
+		return true
+	}
+	return false
+}
+
+// command runs a debugger command and reports whether the paused
+// evaluation was resumed.
+func (d *replDebugger) command(line string) bool {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ":break":
+		if len(fields) == 1 {
+			for _, b := range d.Breakpoints() {
+				fmt.Println(b)
+			}
+			return false
+		}
+		d.setBreakpoint(fields[1])
+		return false
+	case ":clear":
+		d.ClearBreakpoints()
+		return false
+	case ":help":
+		fmt.Println(debugHelp)
+		return false
+	}
+	if d.current == nil {
+		fmt.Println("not paused, use (debug) or :break to stop the evaluation")
+		return false
+	}
+	switch fields[0] {
+	case ":step":
+		return d.resumeWith(glisp.DebugStepInto)
+	case ":next":
+		return d.resumeWith(glisp.DebugStepOver)
+	case ":out":
+		return d.resumeWith(glisp.DebugStepOut)
+	case ":continue":
+		return d.resumeWith(glisp.DebugContinue)
+	case ":abort":
+		return d.resumeWith(glisp.DebugAbort)
+	case ":locals":
+		for _, b := range d.current.Env.LocalBindings() {
+			fmt.Printf("%s = %s\n", b.Name, b.Value.SexpString())
+		}
+	case ":stack":
+		values := d.current.Env.DataStackValues()
+		for i := len(values) - 1; i >= 0; i-- {
+			fmt.Printf("%d: %s\n", i, values[i].SexpString())
+		}
+	case ":bt":
+		for _, frame := range d.current.Env.Stack() {
+			fmt.Println(frame)
+		}
+	}
+	return false
+}
+
+func (d *replDebugger) setBreakpoint(spec string) {
+	if line, err := strconv.Atoi(spec); err == nil {
+		d.BreakOnLine("", line)
+		return
+	}
+	if i := strings.LastIndexByte(spec, ':'); i > 0 {
+		if line, err := strconv.Atoi(spec[i+1:]); err == nil {
+			d.BreakOnLine(spec[:i], line)
+			return
+		}
+	}
+	d.BreakOnFunction(spec)
+}
+
+func (d *replDebugger) resumeWith(action glisp.DebugAction) bool {
+	d.current = nil
+	d.resume <- action
+	return true
+}
@@ -1,37 +1,56 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/qjpcpu/glisp/repl"
 )
 
 func main() {
+	var opts []repl.ReplOption
+	if len(os.Args) > 2 && os.Args[1] == "-profile" {
+		/* glisp -profile OUT ... */
+		opts = append(opts, repl.WithProfile(os.Args[2]))
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compile" {
+		/* glisp compile FILE OUT */
+		if len(os.Args) != 4 {
+			fmt.Println("usage: glisp compile FILE OUT")
+			os.Exit(-1)
+		}
+		if err := repl.CompileScriptTo(os.Args[2], os.Args[3], opts...); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		return
+	}
 	switch len(os.Args) {
 	case 0:
 	case 1:
-		repl.Run()
+		repl.Run(opts...)
 	case 2:
 		if os.Args[1] == "-i" {
 			/* glisp -i */
-			repl.Run()
+			repl.Run(opts...)
 		} else {
 			/* glisp FILE */
 			file := os.Args[1]
 			os.Args = os.Args[1:]
-			repl.RunScript(file, false)
+			repl.RunScript(file, false, opts...)
 		}
 	default:
 		if os.Args[1] == "-i" {
 			/* glisp -i FILE args... */
 			file := os.Args[2]
 			os.Args = os.Args[2:]
-			repl.RunScript(file, true)
+			repl.RunScript(file, true, opts...)
 		} else {
 			/* glisp FILE args... */
 			file := os.Args[1]
 			os.Args = os.Args[1:]
-			repl.RunScript(file, false)
+			repl.RunScript(file, false, opts...)
 		}
 	}
 }
@@ -82,8 +82,10 @@ func processDumpCommand(env *glisp.Environment, args []string) {
 	}
 }
 
-func repl(liner LinerProducer, env *glisp.Environment) {
-	stremRepl := NewStreamRepl(env)
+func repl(r *Repl) {
+	liner, env, debugger := r.liner, r.Environment, r.debugger
+	debugger.interactive = true
+	stremRepl := newStreamRepl(env, debugger)
 	var waitMore bool
 	var pendingCount int
 	handleOutput := func(ret *Result) {
@@ -105,10 +107,20 @@ func repl(liner LinerProducer, env *glisp.Environment) {
 		line, err := readLine(liner, getKeywords(env), waitMore)
 		if err != nil {
 			stremRepl.Stop()
+			r.writeProfile()
 			os.Exit(-1)
 		}
-		stremRepl.Write(line + "\n")
-		pendingCount += len(strings.TrimSpace(line))
+		if cmd := strings.TrimSpace(line); pendingCount == 0 && isDebugCommand(cmd) {
+			if !debugger.command(cmd) {
+				continue
+			}
+		} else if debugger.current != nil {
+			fmt.Println("evaluation is paused, use :continue to resume it")
+			continue
+		} else {
+			stremRepl.Write(line + "\n")
+			pendingCount += len(strings.TrimSpace(line))
+		}
 
 	WAIT_OUTPUT:
 		select {
@@ -119,6 +131,10 @@ func repl(liner LinerProducer, env *glisp.Environment) {
 			}
 		case ret := <-stremRepl.Out():
 			handleOutput(ret)
+		case p := <-debugger.paused:
+			waitMore = false
+			pendingCount = 0
+			debugger.pause(p)
 		}
 		select {
 		case ret := <-stremRepl.Out():
@@ -142,7 +158,11 @@ func runScript(env *Repl, fname string) {
 		os.Exit(-1)
 	}
 
-	err = env.LoadStream(bytes.NewBuffer(dropSheBang(fileContent)))
+	if glisp.IsBytecode(fileContent) {
+		err = env.LoadCompiled(bytes.NewReader(fileContent))
+	} else {
+		err = env.LoadStream(bytes.NewBuffer(dropSheBang(fileContent)))
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -151,6 +171,7 @@ func runScript(env *Repl, fname string) {
 	_, err = env.Run()
 	if err != nil {
 		fmt.Print(env.GetStackTrace(err))
+		env.writeProfile()
 		os.Exit(-1)
 	}
 }
@@ -175,16 +196,45 @@ func NewRepl() *Repl {
 	}
 	env.AddNamedFunction("export-history", exportHistory, glisp.WithDoc(`(export-history FILE)`))
 	env.AddNamedFunction("clear-history", clearHistory, glisp.WithDoc(`(clear-history)`))
-	return &Repl{Environment: env, liner: Default()}
+	debugger := newReplDebugger()
+	env.AddNamedFunction("debug", debugger.debugFunction, glisp.WithDoc(`(debug)
+Pause the evaluation and enter the debugger, type :help for its commands.`))
+	return &Repl{Environment: env, liner: Default(), debugger: debugger}
 }
 
 type Repl struct {
 	*glisp.Environment
-	liner LinerProducer
+	liner    LinerProducer
+	debugger *replDebugger
+	profile  string
 }
 
 func SetLiner(l LinerProducer) ReplOption { return func(r *Repl) { r.liner = l } }
 
+// WithProfile profiles the evaluation and writes a pprof profile to file
+// when the script or the REPL exits.
+func WithProfile(file string) ReplOption {
+	return func(r *Repl) {
+		r.profile = file
+		r.AttachProfiler(glisp.NewProfiler())
+	}
+}
+
+func (r *Repl) writeProfile() {
+	if r.profile == "" {
+		return
+	}
+	f, err := os.Create(r.profile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+	if err := r.Profiler().WriteProfile(f); err != nil {
+		fmt.Println(err)
+	}
+}
+
 type ReplOption func(*Repl)
 
 func RunScript(file string, interactive bool, opts ...ReplOption) {
@@ -194,7 +244,9 @@ func RunScript(file string, interactive bool, opts ...ReplOption) {
 	}
 	runScript(env, file)
 	if interactive {
-		repl(env.liner, env.Environment)
+		repl(env)
+	} else {
+		env.writeProfile()
 	}
 }
 
@@ -207,12 +259,34 @@ func CompileScript(file string, opts ...ReplOption) error {
 	return err
 }
 
+// CompileScriptTo compiles file to bytecode written to out, the bytecode
+// runs like a script but skips parsing and code generation.
+func CompileScriptTo(file string, out string, opts ...ReplOption) error {
+	env := NewRepl()
+	for _, fn := range opts {
+		fn(env)
+	}
+	fileContent, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	exprs, err := env.ParseStream(bytes.NewReader(dropSheBang(fileContent)))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = env.CompileToWriter(&buf, exprs); err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0644)
+}
+
 func Run(opts ...ReplOption) {
 	env := NewRepl()
 	for _, fn := range opts {
 		fn(env)
 	}
-	repl(env.liner, env.Environment)
+	repl(env)
 }
 
 func getRemoteFile(url string) ([]byte, error) {
@@ -16,19 +16,25 @@ type Result struct {
 }
 
 type StreamRepl struct {
-	env     *glisp.Environment
-	input   chan rune
-	output  chan *Result
-	stopc   chan struct{}
-	running int32
+	env      *glisp.Environment
+	debugger *replDebugger
+	input    chan rune
+	output   chan *Result
+	stopc    chan struct{}
+	running  int32
 }
 
 func NewStreamRepl(env *glisp.Environment) *StreamRepl {
+	return newStreamRepl(env, nil)
+}
+
+func newStreamRepl(env *glisp.Environment, debugger *replDebugger) *StreamRepl {
 	sr := &StreamRepl{
-		env:    env,
-		input:  make(chan rune, 1024),
-		output: make(chan *Result, 10),
-		stopc:  make(chan struct{}, 1),
+		env:      env,
+		debugger: debugger,
+		input:    make(chan rune, 1024),
+		output:   make(chan *Result, 10),
+		stopc:    make(chan struct{}, 1),
 	}
 	go sr.start()
 	return sr
@@ -73,6 +79,9 @@ func (sr *StreamRepl) replOnce(lexer *glisp.Lexer) (glisp.Sexp, error) {
 	if err = sr.env.LoadExpressions([]glisp.Sexp{expr}); err != nil {
 		return glisp.SexpNull, errors.New(sr.env.GetStackTrace(err))
 	}
+	if sr.debugger != nil {
+		sr.debugger.attach(sr.env)
+	}
 	atomic.StoreInt32(&sr.running, 1)
 	defer func() {
 		atomic.StoreInt32(&sr.running, 0)
@@ -27,6 +27,9 @@ func NewSexpFloatStr(str string) (SexpFloat, error) {
 }
 
 func NewSexpFloatInt(i SexpInt) SexpFloat {
+	if i.v == nil {
+		return SexpFloat{v: new(big.Float).SetInt64(i.i)}
+	}
 	return SexpFloat{v: new(big.Float).SetInt(i.v)}
 }
 
@@ -94,9 +97,9 @@ func (f SexpFloat) Round() SexpInt {
 	l, _ := new(big.Float).Sub(f.v, new(big.Float).SetInt(leftInt)).Float64()
 	r, _ := new(big.Float).Sub(new(big.Float).SetInt(rightInt), f.v).Float64()
 	if l < r {
-		return SexpInt{v: leftInt}
+		return newSexpIntBig(leftInt)
 	}
-	return SexpInt{v: rightInt}
+	return newSexpIntBig(rightInt)
 }
 
 func (f SexpFloat) intRange() (*big.Int, *big.Int) {
@@ -114,12 +117,12 @@ func (f SexpFloat) intRange() (*big.Int, *big.Int) {
 
 func (f SexpFloat) Ceil() SexpInt {
 	_, rightInt := f.intRange()
-	return SexpInt{v: rightInt}
+	return newSexpIntBig(rightInt)
 }
 
 func (f SexpFloat) Floor() SexpInt {
 	leftInt, _ := f.intRange()
-	return SexpInt{v: leftInt}
+	return newSexpIntBig(leftInt)
 }
 
 func (f SexpFloat) Format(s string) string {
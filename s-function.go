@@ -1,6 +1,12 @@
 package glisp
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 type SexpFunction struct {
 	name       string
@@ -10,8 +16,13 @@ type SexpFunction struct {
 	fun        Function
 	userfun    UserFunction
 	closeScope *ScopeStack
+	// frame names the parameters and other local variables
+	frame      *Frame
 	doc        string
 	nameRegexp *regexp.Regexp
+	// arities holds the bodies of a function defined with one per arity,
+	// calls run the body selected by arity
+	arities []*SexpFunction
 }
 
 func (sf *SexpFunction) SexpString() string {
@@ -25,3 +36,37 @@ func (sf *SexpFunction) Clone() *SexpFunction {
 
 func (sf *SexpFunction) Doc() string  { return sf.doc }
 func (sf *SexpFunction) Name() string { return sf.name }
+
+// arity returns the body of sf run by a call with nargs arguments, the body
+// taking exactly nargs arguments or else the variadic body.
+func (sf *SexpFunction) arity(nargs int) (*SexpFunction, error) {
+	var variadic *SexpFunction
+	for _, body := range sf.arities {
+		if body.varargs {
+			variadic = body
+		} else if body.nargs == nargs {
+			return body, nil
+		}
+	}
+	if variadic != nil && nargs >= variadic.nargs {
+		return variadic, nil
+	}
+	var fixed []int
+	for _, body := range sf.arities {
+		if !body.varargs {
+			fixed = append(fixed, body.nargs)
+		}
+	}
+	sort.Ints(fixed)
+	expect := make([]string, 0, len(sf.arities))
+	for _, n := range fixed {
+		expect = append(expect, strconv.Itoa(n))
+	}
+	if variadic != nil {
+		expect = append(expect, "at least "+strconv.Itoa(variadic.nargs))
+	}
+	if n := len(expect); n > 1 {
+		expect = append(expect[:n-2], expect[n-2]+" or "+expect[n-1])
+	}
+	return nil, fmt.Errorf("%s expected %s arguments, got %d", sf.name, strings.Join(expect, ", "), nargs)
+}
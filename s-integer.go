@@ -2,36 +2,57 @@ package glisp
 
 import (
 	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
+	"strconv"
 )
 
+// SexpInt is an integer of arbitrary size. Integers fitting in an int64 are
+// stored inline in i and v is nil, larger ones are stored in v, so the
+// representation of a value is unique.
 type SexpInt struct {
+	i int64
 	v *big.Int
 }
 
 func NewSexpInt(i int) SexpInt {
-	return SexpInt{v: big.NewInt(int64(i))}
+	return SexpInt{i: int64(i)}
 }
 
 func NewSexpInt64(i int64) SexpInt {
-	return SexpInt{v: new(big.Int).SetInt64(i)}
+	return SexpInt{i: i}
 }
 
 func NewSexpUint64(i uint64) SexpInt {
+	if i <= math.MaxInt64 {
+		return SexpInt{i: int64(i)}
+	}
 	return SexpInt{v: new(big.Int).SetUint64(i)}
 }
+
+// newSexpIntBig returns the integer v, inline if it fits in an int64.
+func newSexpIntBig(v *big.Int) SexpInt {
+	if v.IsInt64() {
+		return SexpInt{i: v.Int64()}
+	}
+	return SexpInt{v: v}
+}
+
 func NewSexpIntStr(str string) (SexpInt, error) {
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return SexpInt{i: i}, nil
+	}
 	v, ok := new(big.Int).SetString(str, 10)
 	if !ok {
 		return SexpInt{}, fmt.Errorf(`%s not number`, str)
 	}
-	return SexpInt{v: v}, nil
+	return newSexpIntBig(v), nil
 }
 
 func NewSexpIntBytes(bs []byte) SexpInt {
 	v := new(big.Int).SetBytes(bs)
-	return SexpInt{v: v}
+	return newSexpIntBig(v)
 }
 
 func NewSexpIntStrWithBase(str string, base int) (SexpInt, error) {
@@ -44,80 +65,165 @@ func NewSexpIntStrWithBase(str string, base int) (SexpInt, error) {
 		base = 10
 	}
 	if bigint, ok := big.NewInt(0).SetString(str, base); ok {
-		return SexpInt{v: bigint}, nil
+		return newSexpIntBig(bigint), nil
 	}
 	return SexpInt{}, fmt.Errorf(`can't parse %s to number`, str)
 }
 
+// toBig returns the value as a big.Int, the caller must not modify it.
+func (i SexpInt) toBig() *big.Int {
+	if i.v != nil {
+		return i.v
+	}
+	return big.NewInt(i.i)
+}
+
 func (i SexpInt) SexpString() string {
+	if i.v == nil {
+		return strconv.FormatInt(i.i, 10)
+	}
 	return i.v.String()
 }
 
 func (i SexpInt) Format(s string) string {
-	return fmt.Sprintf(s, i.v)
+	return fmt.Sprintf(s, i.toBig())
 }
 
 func (i SexpInt) BitNot() SexpInt {
-	return SexpInt{v: new(big.Int).Not(i.v)}
+	if i.v == nil {
+		return SexpInt{i: ^i.i}
+	}
+	return newSexpIntBig(new(big.Int).Not(i.v))
 }
 
 func (i SexpInt) Xor(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Xor(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		return SexpInt{i: i.i ^ j.i}
+	}
+	return newSexpIntBig(new(big.Int).Xor(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) Add(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Add(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		if s := i.i + j.i; (s > i.i) == (j.i > 0) {
+			return SexpInt{i: s}
+		}
+	}
+	return newSexpIntBig(new(big.Int).Add(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) Sub(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Sub(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		if d := i.i - j.i; (d < i.i) == (j.i > 0) {
+			return SexpInt{i: d}
+		}
+	}
+	return newSexpIntBig(new(big.Int).Sub(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) Mul(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Mul(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		if i.i == 0 || j.i == 0 {
+			return SexpInt{}
+		}
+		p := i.i * j.i
+		if p/j.i == i.i && !(i.i == -1 && j.i == math.MinInt64) && !(j.i == -1 && i.i == math.MinInt64) {
+			return SexpInt{i: p}
+		}
+	}
+	return newSexpIntBig(new(big.Int).Mul(i.toBig(), j.toBig()))
 }
 
+// Div is the Euclidean division like big.Int.Div, it panics if j is zero.
 func (i SexpInt) Div(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Div(i.v, j.v)}
+	if i.v == nil && j.v == nil && !(i.i == math.MinInt64 && j.i == -1) {
+		q, r := i.i/j.i, i.i%j.i
+		if r < 0 {
+			if j.i > 0 {
+				q--
+			} else {
+				q++
+			}
+		}
+		return SexpInt{i: q}
+	}
+	return newSexpIntBig(new(big.Int).Div(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) ShiftLeft(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Lsh(i.v, uint(j.v.Uint64()))}
+	n := uint(j.ToUint64())
+	if i.v == nil && n < 63 {
+		if s := i.i << n; s>>n == i.i {
+			return SexpInt{i: s}
+		}
+	}
+	return newSexpIntBig(new(big.Int).Lsh(i.toBig(), n))
 }
 
 func (i SexpInt) ShiftRight(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Rsh(i.v, uint(j.v.Uint64()))}
+	n := uint(j.ToUint64())
+	if i.v == nil {
+		return SexpInt{i: i.i >> n}
+	}
+	return newSexpIntBig(new(big.Int).Rsh(i.v, n))
 }
 
+// Mod is the Euclidean modulus like big.Int.Mod, it panics if j is zero.
 func (i SexpInt) Mod(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Mod(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		if j.i == -1 {
+			return SexpInt{}
+		}
+		r := i.i % j.i
+		if r < 0 {
+			if j.i > 0 {
+				r += j.i
+			} else {
+				r -= j.i
+			}
+		}
+		return SexpInt{i: r}
+	}
+	return newSexpIntBig(new(big.Int).Mod(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) And(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).And(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		return SexpInt{i: i.i & j.i}
+	}
+	return newSexpIntBig(new(big.Int).And(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) Or(j SexpInt) SexpInt {
-	return SexpInt{v: new(big.Int).Or(i.v, j.v)}
+	if i.v == nil && j.v == nil {
+		return SexpInt{i: i.i | j.i}
+	}
+	return newSexpIntBig(new(big.Int).Or(i.toBig(), j.toBig()))
 }
 
 func (i SexpInt) IsZero() bool {
-	return i.v.Cmp(big.NewInt(0)) == 0
+	return i.v == nil && i.i == 0
 }
 
 func (i SexpInt) IsInt64() bool {
-	return i.v.IsInt64()
+	return i.v == nil
 }
 
 func (i SexpInt) IsUint64() bool {
+	if i.v == nil {
+		return i.i >= 0
+	}
 	return i.v.IsUint64()
 }
 
 func (i SexpInt) Random(rnd *rand.Rand) SexpInt {
-	return SexpInt{v: new(big.Int).Rand(rnd, i.v)}
+	return newSexpIntBig(new(big.Int).Rand(rnd, i.toBig()))
 }
 
 func (i SexpInt) ToInt64() int64 {
+	if i.v == nil {
+		return i.i
+	}
 	return i.v.Int64()
 }
 
@@ -126,13 +232,39 @@ func (i SexpInt) ToInt() int {
 }
 
 func (i SexpInt) ToUint64() uint64 {
-	return i.v.Uint64()
+	if i.v == nil && i.i >= 0 {
+		return uint64(i.i)
+	}
+	return i.toBig().Uint64()
 }
 
 func (i SexpInt) ToBytes() []byte {
-	return i.v.Bytes()
+	return i.toBig().Bytes()
 }
 
 func (i SexpInt) Sign() int {
+	if i.v == nil {
+		switch {
+		case i.i < 0:
+			return -1
+		case i.i > 0:
+			return 1
+		}
+		return 0
+	}
 	return i.v.Sign()
 }
+
+// cmp compares i and j like big.Int.Cmp.
+func (i SexpInt) cmp(j SexpInt) int {
+	if i.v == nil && j.v == nil {
+		switch {
+		case i.i < j.i:
+			return -1
+		case i.i > j.i:
+			return 1
+		}
+		return 0
+	}
+	return i.toBig().Cmp(j.toBig())
+}
@@ -8,10 +8,12 @@ import (
 type SexpPair struct {
 	head Sexp
 	tail Sexp
+	// pos is set by the parser on the first pair of a list
+	pos *Position
 }
 
 func Cons(a Sexp, b Sexp) *SexpPair {
-	return &SexpPair{a, b}
+	return &SexpPair{head: a, tail: b}
 }
 
 func (pair *SexpPair) Head() Sexp {
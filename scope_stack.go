@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 // Scope defines a single layer of lexical bindings, mapping symbol numbers to their Sexp values.
@@ -27,16 +28,69 @@ type ScopeStack struct {
 	top, bottom *ScopeLayer
 }
 
+// Frame names the local variables of a function call or a let scope. The
+// generator resolves references to them to slots of the frame, the names
+// keep them visible to lookups by symbol such as those of eval.
+type Frame struct {
+	names []SexpSymbol
+}
+
+// slot returns the slot of the symbol numbered n or -1.
+func (f *Frame) slot(n int) int {
+	if f == nil {
+		return -1
+	}
+	for i, sym := range f.names {
+		if sym.number == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// declare returns the slot of sym, adding it if the frame lacks one.
+func (f *Frame) declare(sym SexpSymbol) int {
+	if i := f.slot(sym.number); i >= 0 {
+		return i
+	}
+	f.names = append(f.names, sym)
+	return len(f.names) - 1
+}
+
+func (f *Frame) size() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.names)
+}
+
 // ScopeLayer represents a single frame in the scope stack.
 type ScopeLayer struct {
+	// Scope holds the bindings made by name, it is allocated by the first
+	// of them.
 	Scope Scope
+	// slots holds the local variables named by frame, unbound slots are nil.
+	slots []Sexp
+	frame *Frame
+	// overlay marks a layer pushed by copy-on-write over a shared layer of
+	// the same frame, it is part of the scope below it.
+	overlay bool
 	// ref is the reference count. A layer can be shared by multiple ScopeStacks
 	// (e.g., a parent function's scope and a closure's scope). This count
 	// tracks how many stacks are currently referencing this layer.
-	// The layer is only recycled when ref drops to 0.
-	ref int
+	// The layer is only recycled when ref drops to 0. Coroutines share
+	// layers, so it is only changed atomically.
+	ref int32
 	// next points to the parent scope layer in the stack.
 	next *ScopeLayer
+	// level is the number of layers from the bottom up to this one.
+	level int
+	// frozen marks the global scope of a parent environment, which is only
+	// read by its children.
+	frozen atomic.Bool
+	// consts holds the symbols frozen by Freeze or defconst, it is only set
+	// in global scopes.
+	consts map[int]bool
 }
 
 // NewScopeStack creates and returns an empty ScopeStack.
@@ -47,10 +101,12 @@ func NewScopeStack() *ScopeStack {
 // newScope retrieves a Scope map from the object pool.
 func newScope() Scope { return scopePool.Get().(Scope) }
 
-// newScopeLayer retrieves a ScopeLayer from the object pool and initializes it
-// with a new, empty Scope.
+// newScopeLayer retrieves a ScopeLayer from the object pool, its Scope is
+// allocated on the first binding by name.
 func newScopeLayer() *ScopeLayer {
-	return newScopeLayerWith(newScope())
+	layer := scopeLayerPool.Get().(*ScopeLayer)
+	atomic.StoreInt32(&layer.ref, 1)
+	return layer
 }
 
 // newScopeLayerWith retrieves a ScopeLayer from the object pool and initializes it
@@ -59,22 +115,65 @@ func newScopeLayerWith(s Scope) *ScopeLayer {
 	if s == nil {
 		s = newScope()
 	}
-	layer := scopeLayerPool.Get().(*ScopeLayer)
-	layer.ref = 1
+	layer := newScopeLayer()
 	layer.Scope = s
 	return layer
 }
 
+// newFrameLayer retrieves a ScopeLayer from the object pool with unbound
+// slots for the local variables of frame.
+func newFrameLayer(frame *Frame) *ScopeLayer {
+	layer := newScopeLayer()
+	layer.frame = frame
+	layer.allocSlots()
+	return layer
+}
+
+func (s *ScopeLayer) allocSlots() {
+	n := s.frame.size()
+	if cap(s.slots) >= n {
+		s.slots = s.slots[:n]
+	} else {
+		s.slots = make([]Sexp, n)
+	}
+}
+
+// setSlot binds slot i, the slots of an overlay are allocated on the first
+// binding.
+func (s *ScopeLayer) setSlot(i int, e Sexp) error {
+	if len(s.slots) == 0 {
+		s.allocSlots()
+	}
+	if i >= len(s.slots) {
+		return fmt.Errorf("local slot %d out of range", i)
+	}
+	s.slots[i] = e
+	return nil
+}
+
 // IsStackElem is a marker method for the StackElem interface.
 func (s *ScopeLayer) IsStackElem() {}
 
 // Clone creates a deep copy of the ScopeLayer and its underlying Scope map.
 func (s *ScopeLayer) Clone() *ScopeLayer { // newScopeLayer() ref is 1
-	newScope := newScopeLayer()
-	for k, v := range s.Scope {
-		newScope.Scope[k] = v
+	layer := newScopeLayer()
+	if s.Scope != nil {
+		layer.Scope = newScope()
+		for k, v := range s.Scope {
+			layer.Scope[k] = v
+		}
 	}
-	return newScope
+	layer.frame = s.frame
+	layer.overlay = s.overlay
+	layer.level = s.level
+	if s.consts != nil {
+		layer.consts = make(map[int]bool, len(s.consts))
+		for k := range s.consts {
+			layer.consts[k] = true
+		}
+	}
+	layer.slots = append(layer.slots[:0], s.slots...)
+	return layer
 }
 
 // Find searches for a symbol's value within this specific scope layer.
@@ -82,19 +181,35 @@ func (s *ScopeLayer) Find(n int) (Sexp, bool) {
 	if expr, ok := s.Scope[n]; ok {
 		return expr, true
 	}
+	if i := s.frame.slot(n); i >= 0 && i < len(s.slots) && s.slots[i] != nil {
+		return s.slots[i], true
+	}
 	return SexpNull, false
 }
 
-// Bind sets the value for a symbol in this specific scope layer.
+// Bind sets the value for a symbol in this specific scope layer, local
+// variables of its frame are bound in their slot.
 func (s *ScopeLayer) Bind(n int, e Sexp) {
+	if i := s.frame.slot(n); i >= 0 {
+		s.setSlot(i, e)
+		return
+	}
+	if s.Scope == nil {
+		s.Scope = newScope()
+	}
+	old, ok := s.Scope[n]
 	s.Scope[n] = e
+	if !ok || IsFunction(old) || IsFunction(e) {
+		// the binding may hide or replace a function cached by calls
+		bindEpoch.Add(1)
+	}
 }
 
 // incrRef increments the reference count of all layers from the given 'top'
 // layer down to the bottom of the stack. This is called when a stack is forked.
 func (stack *ScopeStack) incrRef(top *ScopeLayer) {
 	for ptr := top; ptr != nil; {
-		ptr.ref++
+		atomic.AddInt32(&ptr.ref, 1)
 		ptr = ptr.next
 	}
 }
@@ -122,6 +237,87 @@ func (stack *ScopeStack) ForkBottom() *ScopeStack {
 	return st
 }
 
+// ForkGlobal creates a ScopeStack whose global scope is a new, empty layer
+// over the global scope of the original stack. Global bindings of the new
+// stack go to its own layer, the layers below it are only read.
+func (stack *ScopeStack) ForkGlobal() *ScopeStack {
+	st := stack.ForkBottom()
+	st.push(newScopeLayer())
+	st.bottom = st.top
+	return st
+}
+
+// Freeze makes the global scope of the stack read-only, binding or setting
+// a symbol in it fails from then on.
+func (stack *ScopeStack) Freeze() {
+	if stack.bottom != nil {
+		stack.bottom.frozen.Store(true)
+	}
+}
+
+// isConst reports whether sym was frozen in the global scope or in the
+// layers below it.
+func (stack *ScopeStack) isConst(sym SexpSymbol) bool {
+	for ptr := stack.bottom; ptr != nil; ptr = ptr.next {
+		if ptr.consts[sym.number] {
+			return true
+		}
+	}
+	return false
+}
+
+// freezeSymbol makes the global binding of sym constant.
+func (stack *ScopeStack) freezeSymbol(sym SexpSymbol) error {
+	if stack.IsEmpty() {
+		return errors.New("no scope available")
+	}
+	if stack.bottom.frozen.Load() {
+		return frozenError(sym)
+	}
+	if stack.bottom.consts == nil {
+		stack.bottom.consts = make(map[int]bool)
+	}
+	stack.bottom.consts[sym.number] = true
+	return nil
+}
+
+// freezeGlobals makes every global binding constant.
+func (stack *ScopeStack) freezeGlobals() error {
+	if stack.IsEmpty() {
+		return errors.New("no scope available")
+	}
+	if stack.bottom.frozen.Load() {
+		return errors.New("cannot freeze bindings of a frozen scope")
+	}
+	if stack.bottom.consts == nil {
+		stack.bottom.consts = make(map[int]bool)
+	}
+	for layer := stack.bottom; layer != nil; layer = layer.next {
+		for k := range layer.Scope {
+			stack.bottom.consts[k] = true
+		}
+	}
+	return nil
+}
+
+// ErrFrozen is wrapped by the error of a binding changed in a frozen scope,
+// or frozen by Freeze or defconst.
+var ErrFrozen = errors.New("binding is frozen")
+
+// frozenError is the error of a binding changed in a frozen scope.
+func frozenError(sym SexpSymbol) error {
+	return fmt.Errorf("cannot change `%s`: %w", sym.name, ErrFrozen)
+}
+
+// base returns the layer below the global scope, which is only set for
+// stacks made by ForkGlobal.
+func (stack *ScopeStack) base() *ScopeLayer {
+	if stack.bottom == nil {
+		return nil
+	}
+	return stack.bottom.next
+}
+
 // IsStackElem is a marker method for the StackElem interface.
 func (stack *ScopeStack) IsStackElem() {}
 
@@ -139,7 +335,7 @@ func (stack *ScopeStack) Clone() *ScopeStack {
 			prev2.next = ptr2
 		}
 		prev2 = ptr2
-		if ptr.next == nil {
+		if ptr == stack.bottom {
 			stack2.bottom = ptr2
 		}
 		ptr = ptr.next
@@ -154,12 +350,12 @@ func (stack *ScopeStack) push(layer *ScopeLayer) {
 	}
 	if stack.top != nil {
 		layer.next = stack.top
+		layer.level = stack.top.level + 1
 	} else {
 		stack.bottom = layer
+		layer.level = 1
 	}
-	if layer.ref == 0 {
-		layer.ref = 1
-	}
+	atomic.CompareAndSwapInt32(&layer.ref, 0, 1)
 	stack.top = layer
 }
 
@@ -170,12 +366,11 @@ func (stack *ScopeStack) Pop() error {
 		return errors.New("pop from empty scope stack")
 	}
 	cur := stack.top
-	cur.ref--
 	stack.top = cur.next
 	if stack.top == nil {
 		stack.bottom = nil
 	}
-	recycleScopeLayer(cur)
+	cur.release()
 	return nil
 }
 
@@ -185,11 +380,30 @@ func (stack *ScopeStack) PushScope() {
 	stack.Push()
 }
 
-// PopScope removes the top scope from the stack.
+// PushFrame pushes a scope with unbound slots for the local variables of
+// frame, this is used for function calls and let.
+func (stack *ScopeStack) PushFrame(frame *Frame) {
+	stack.push(newFrameLayer(frame))
+}
+
+// PopScope removes the top scope from the stack, together with the
+// overlays copy-on-write pushed over it.
 func (stack *ScopeStack) PopScope() error {
+	for stack.top != nil && stack.top.overlay {
+		stack.Pop()
+	}
 	return stack.Pop()
 }
 
+// pushOverlay pushes an empty layer over the shared top layer, bindings
+// made in it stay invisible to the closures sharing the top layer.
+func (stack *ScopeStack) pushOverlay() {
+	layer := newScopeLayer()
+	layer.frame = stack.top.frame
+	layer.overlay = true
+	stack.push(layer)
+}
+
 // Push adds one or more pre-existing scopes to the top of the stack.
 func (stack *ScopeStack) Push(scopes ...Scope) {
 	if len(scopes) == 0 {
@@ -199,13 +413,41 @@ func (stack *ScopeStack) Push(scopes ...Scope) {
 		for i := range scopes {
 			stack.push(newScopeLayerWith(scopes[i]))
 		}
+		bindEpoch.Add(1)
 	}
 }
 
 // LookupSymbol searches for a symbol starting from the top of the stack and
 // moving down through parent scopes until the symbol is found.
 func (stack *ScopeStack) LookupSymbol(sym SexpSymbol) (Sexp, error) {
-	for ptr := stack.top; ptr != nil; {
+	return lookupFrom(stack.top, sym)
+}
+
+// declaredLocally reports whether a scope above the global one binds sym or
+// has a local variable named sym.
+func (stack *ScopeStack) declaredLocally(sym SexpSymbol) bool {
+	for ptr := stack.top; ptr != nil && ptr != stack.bottom; ptr = ptr.next {
+		if _, ok := ptr.Scope[sym.number]; ok || ptr.frame.slot(sym.number) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDynamicScope reports whether a scope above the global one binds its
+// names at run time, like the let of a list, so the names it binds are not
+// known at compile time.
+func (stack *ScopeStack) hasDynamicScope() bool {
+	for ptr := stack.top; ptr != nil && ptr != stack.bottom; ptr = ptr.next {
+		if ptr.frame == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupFrom(layer *ScopeLayer, sym SexpSymbol) (Sexp, error) {
+	for ptr := layer; ptr != nil; {
 		if expr, ok := ptr.Find(sym.number); ok {
 			return expr, nil
 		}
@@ -214,19 +456,98 @@ func (stack *ScopeStack) LookupSymbol(sym SexpSymbol) (Sexp, error) {
 	return SexpNull, fmt.Errorf("symbol `%v` not found", sym.Name())
 }
 
+// local finds the local variable in slot of the frame depth scopes below
+// the top, the overlays of the frame come before it. It returns the layer
+// binding the slot, or the layer of the frame and false if the slot is
+// unbound. The layer is nil if the stack has fewer frames.
+func (stack *ScopeStack) local(depth, slot int) (*ScopeLayer, bool) {
+	for ptr := stack.top; ptr != nil; ptr = ptr.next {
+		if depth == 0 {
+			if slot < len(ptr.slots) && ptr.slots[slot] != nil {
+				return ptr, true
+			}
+			if !ptr.overlay {
+				return ptr, false
+			}
+		} else if !ptr.overlay {
+			depth--
+		}
+	}
+	return nil, false
+}
+
+// LookupLocal returns the local variable sym the generator resolved to slot
+// of the frame depth scopes below the top. While the slot is unbound, for
+// instance before the def binding it ran, sym is looked up by name in the
+// scopes enclosing the frame.
+func (stack *ScopeStack) LookupLocal(sym SexpSymbol, depth, slot int) (Sexp, error) {
+	layer, ok := stack.local(depth, slot)
+	if ok {
+		return layer.slots[slot], nil
+	}
+	if layer == nil {
+		return stack.LookupSymbol(sym)
+	}
+	return lookupFrom(layer.next, sym)
+}
+
+// SetLocal updates the local variable sym the generator resolved to slot of
+// the frame depth scopes below the top, like SetSymbol it may mutate a
+// shared scope.
+func (stack *ScopeStack) SetLocal(sym SexpSymbol, depth, slot int, expr Sexp) error {
+	layer, ok := stack.local(depth, slot)
+	if ok {
+		layer.slots[slot] = expr
+		return nil
+	}
+	if layer == nil {
+		return stack.SetSymbol(sym, expr)
+	}
+	for ptr := layer.next; ptr != nil; ptr = ptr.next {
+		if _, ok := ptr.Find(sym.number); ok {
+			ptr.Bind(sym.number, expr)
+			return nil
+		}
+	}
+	return stack.BindSymbol(sym, expr)
+}
+
+// BindLocal binds slot of the frame of the top scope, it follows the
+// copy-on-write strategy of BindSymbol.
+func (stack *ScopeStack) BindLocal(slot int, expr Sexp) error {
+	if stack.IsEmpty() {
+		return errors.New("no scope available")
+	}
+	if stack.top != stack.bottom && stack.top.shared() {
+		stack.pushOverlay()
+	}
+	return stack.top.setSlot(slot, expr)
+}
+
 // GlobalFuntions returns a list of function names found in the global scope (bottom layer).
 func (stack *ScopeStack) GlobalFuntions() (ret []string) {
 	if stack.IsEmpty() {
 		return nil
 	}
-	for _, v := range stack.bottom.Scope {
-		if fn, ok := v.(*SexpFunction); ok {
-			ret = append(ret, fn.name)
+	// the global scope of a stack made by ForkGlobal lies over others
+	for layer := stack.bottom; layer != nil; layer = layer.next {
+		for _, v := range layer.Scope {
+			if fn, ok := v.(*SexpFunction); ok {
+				ret = append(ret, fn.name)
+			}
 		}
 	}
 	return
 }
 
+// Depth returns the number of layers of the stack.
+func (stack *ScopeStack) Depth() int {
+	if stack.top == nil {
+		return 0
+	}
+	return stack.top.level
+}
+
 // IsEmpty returns true if the stack has no layers.
 func (stack *ScopeStack) IsEmpty() bool {
 	return stack.top == nil
@@ -252,6 +573,9 @@ func (stack *ScopeStack) BindSymbol(sym SexpSymbol, expr Sexp, options ...BindSy
 		return errors.New("no scope available")
 	}
 	if len(options) > 0 && options[0] == BIND_GLOBAL {
+		if stack.bottom.frozen.Load() || stack.isConst(sym) {
+			return frozenError(sym)
+		}
 		stack.bottom.Bind(sym.number, expr)
 	} else {
 		// This is the heart of the Copy-on-Write (COW) strategy.
@@ -270,8 +594,11 @@ func (stack *ScopeStack) BindSymbol(sym SexpSymbol, expr Sexp, options ...BindSy
 		// If both are true, we push a new, unshared scope onto the stack before binding.
 		// This ensures that the new binding is local to the current environment and
 		// does not affect the closure's captured scope.
-		if stack.top != stack.bottom && stack.top.ref > 1 {
-			stack.PushScope()
+		if stack.top != stack.bottom && stack.top.shared() {
+			stack.pushOverlay()
+		}
+		if stack.top.frozen.Load() || stack.top == stack.bottom && stack.isConst(sym) {
+			return frozenError(sym)
 		}
 		stack.top.Bind(sym.number, expr)
 	}
@@ -283,16 +610,27 @@ func (stack *ScopeStack) BindSymbol(sym SexpSymbol, expr Sexp, options ...BindSy
 // modifies its value in-place.
 //
 // NOTE: By design, this can mutate a shared parent scope. This behavior is
-// intentional to mimic `set!` in many Lisp dialects.
+// intentional to mimic `set!` in many Lisp dialects. Only the layers below
+// the global scope of a stack made by ForkGlobal are never mutated, the
+// symbol is bound in the global scope instead, and a frozen scope is never
+// mutated at all.
 func (stack *ScopeStack) SetSymbol(sym SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		return errors.New("no scope available")
 	}
+	var below bool
 	for ptr := stack.top; ptr != nil; {
 		if _, ok := ptr.Find(sym.number); ok {
+			if below {
+				ptr = stack.bottom
+			}
+			if ptr.frozen.Load() || ptr == stack.bottom && stack.isConst(sym) {
+				return frozenError(sym)
+			}
 			ptr.Bind(sym.number, expr)
 			return nil
 		}
+		below = below || ptr == stack.bottom
 		ptr = ptr.next
 	}
 	return stack.BindSymbol(sym, expr)
@@ -304,9 +642,8 @@ func (stack *ScopeStack) SetSymbol(sym SexpSymbol, expr Sexp) error {
 func (stack *ScopeStack) Clear() {
 	for stack.top != nil {
 		cur := stack.top
-		cur.ref--
 		stack.top = cur.next
-		recycleScopeLayer(cur)
+		cur.release()
 	}
 	stack.bottom = nil
 }
@@ -331,16 +668,41 @@ func recycleScope(s Scope) {
 	}
 }
 
-// recycleScopeLayer checks if a ScopeLayer's reference count is zero.
-// If it is, the layer and its underlying Scope map are cleaned up and
-// returned to their respective object pools.
+// shared reports whether more than one stack references the layer.
+func (s *ScopeLayer) shared() bool {
+	return atomic.LoadInt32(&s.ref) > 1
+}
+
+// release drops a reference to the layer and recycles it once no stack
+// references it.
+func (s *ScopeLayer) release() {
+	if atomic.AddInt32(&s.ref, -1) <= 0 {
+		recycleScopeLayer(s)
+	}
+}
+
+// recycleScopeLayer cleans up a ScopeLayer no stack references any more,
+// the layer and its underlying Scope map are returned to their respective
+// object pools.
 func recycleScopeLayer(layer *ScopeLayer) {
-	if layer == nil || layer.ref > 0 {
+	if layer == nil {
 		return
 	}
+	if layer.Scope != nil {
+		// calls may have cached a function bound in the layer, which
+		// could be reused as the global scope of another environment
+		bindEpoch.Add(1)
+	}
 	recycleScope(layer.Scope)
 	layer.Scope = nil
+	clear(layer.slots)
+	layer.slots = layer.slots[:0]
+	layer.frame = nil
+	layer.overlay = false
 	layer.next = nil
-	layer.ref = 0
+	layer.level = 0
+	layer.frozen.Store(false)
+	layer.consts = nil
+	atomic.StoreInt32(&layer.ref, 0)
 	scopeLayerPool.Put(layer)
 }
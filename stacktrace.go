@@ -0,0 +1,114 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StackFrame is one active function call, PC is -1 for Go functions and
+// Pos is the zero Position when the source location is unknown.
+type StackFrame struct {
+	Function string
+	PC       int
+	Pos      Position
+	Nargs    int
+}
+
+func (f StackFrame) String() string {
+	if f.Pos.IsValid() {
+		return fmt.Sprintf("%s:%d (%s)", f.Function, f.PC, f.Pos)
+	}
+	return fmt.Sprintf("%s:%d", f.Function, f.PC)
+}
+
+// RuntimeError is returned by Run when an error is not caught. Pos is the
+// position of the expression that raised it and Stack the active calls,
+// innermost first.
+type RuntimeError struct {
+	Err   error
+	Pos   Position
+	Stack []StackFrame
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %v", e.Pos, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// newRuntimeError records the current stack in err, errors raised by nested
+// runs already carry the deeper stack and are returned as is.
+func (env *Environment) newRuntimeError(err error) error {
+	var rtErr *RuntimeError
+	if errors.As(err, &rtErr) {
+		return err
+	}
+	if e, ok := err.(*instrError); ok {
+		return &RuntimeError{Err: e.err, Pos: *e.pos, Stack: env.Stack()}
+	}
+	rtErr = &RuntimeError{Err: err, Stack: env.Stack()}
+	for _, frame := range rtErr.Stack {
+		if frame.Pos.IsValid() {
+			rtErr.Pos = frame.Pos
+			break
+		}
+	}
+	return rtErr
+}
+
+// instrError is an error raised by an instruction after it moved pc to
+// the next one, it keeps the position of the instruction.
+type instrError struct {
+	err error
+	pos *Position
+}
+
+func (e *instrError) Error() string { return e.err.Error() }
+
+func (e *instrError) Unwrap() error { return e.err }
+
+// errorAt reports err at the position of instr.
+func errorAt(instr Instruction, err error) error {
+	if instr.Pos == nil {
+		return err
+	}
+	return &instrError{err: err, pos: instr.Pos}
+}
+
+// Stack returns the active function calls, innermost first, it leaves the
+// stacks untouched.
+func (env *Environment) Stack() []StackFrame {
+	frames := make([]StackFrame, 0, env.addrstack.Top()+2)
+	fn, pc := env.curfunc, env.pc
+	for i := 0; ; i++ {
+		frame := StackFrame{Function: fn.name, PC: pc}
+		if fn.user {
+			frame.PC = -1
+		} else if pos := instrPosition(fn, pc); pos != nil {
+			frame.Pos = *pos
+		}
+		addr, err := env.addrstack.Get(i)
+		if err != nil {
+			frames = append(frames, frame)
+			return frames
+		}
+		frame.Nargs = addr.nargs
+		frames = append(frames, frame)
+		fn, pc = addr.function, addr.position-1
+	}
+}
+
+func instrPosition(fn *SexpFunction, pc int) *Position {
+	if pc >= len(fn.fun) {
+		pc = len(fn.fun) - 1
+	}
+	if pc < 0 {
+		return nil
+	}
+	return fn.fun[pc].Pos
+}
@@ -0,0 +1,75 @@
+package glisp
+
+import (
+	"strconv"
+	"sync"
+)
+
+// symbolTable numbers the names of symbols. It is shared by an environment
+// and every environment duplicated from it, so coroutines started by `go`
+// agree on the numbers. Names already interned are looked up without
+// locking, new names are numbered under mu.
+type symbolTable struct {
+	mu      sync.Mutex
+	numbers sync.Map // name to number
+	names   sync.Map // number to name
+	// next is the number of the next new symbol, guarded by mu
+	next int64
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{next: 1}
+}
+
+// intern returns the number of name, numbering it if it is new.
+func (t *symbolTable) intern(name string) int {
+	if num, ok := t.numbers.Load(name); ok {
+		return num.(int)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.internLocked(name)
+}
+
+func (t *symbolTable) internLocked(name string) int {
+	if num, ok := t.numbers.Load(name); ok {
+		return num.(int)
+	}
+	num := int(t.next)
+	t.next++
+	// store the name first, whoever finds the number also finds its name
+	t.names.Store(num, name)
+	t.numbers.Store(name, num)
+	return num
+}
+
+// gensym interns a name made of prefix and the number of the next symbol.
+func (t *symbolTable) gensym(prefix string) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := prefix + strconv.FormatInt(t.next, 10)
+	return name, t.internLocked(name)
+}
+
+// name returns the name of the symbol numbered num.
+func (t *symbolTable) name(num int) string {
+	name, _ := t.names.Load(num)
+	str, _ := name.(string)
+	return str
+}
+
+// clone returns an independent copy of the table.
+func (t *symbolTable) clone() *symbolTable {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := &symbolTable{next: t.next}
+	t.numbers.Range(func(k, v any) bool {
+		ret.numbers.Store(k, v)
+		return true
+	})
+	t.names.Range(func(k, v any) bool {
+		ret.names.Store(k, v)
+		return true
+	})
+	return ret
+}
@@ -0,0 +1,48 @@
+                                        ; overflow switches to big integers and back
+(def max 9223372036854775807)
+(def min -9223372036854775808)
+(assert (= 9223372036854775808 (+ max 1)))
+(assert (= max (- (+ max 1) 1)))
+(assert (= -9223372036854775809 (- min 1)))
+(assert (= 18446744073709551614 (* max 2)))
+(assert (= 9223372036854775808 (* min -1)))
+(assert (= 85070591730234615847396907784232501249 (* max max)))
+(assert (= min (/ (* min 4) 4)))
+(assert (> (+ max 1) max))
+(assert (< (- min 1) min 0))
+(assert (= 9223372036854775808 (sla 1 63)))
+(assert (= 1 (sra (sla 1 100) 100)))
+(assert (= -1 (sra -1 100)))
+(assert (= 4611686018427387904 (sra (+ max 1) 1)))
+
+                                        ; division and modulus round like big integers
+(assert (= 2 (mod -7 3)))
+(assert (= 1 (mod 7 -3)))
+(assert (= 2 (mod -7 -3)))
+(assert (= 0 (mod min -1)))
+(assert (= 3 (/ 6 2)))
+(assert (= -3 (/ -6 2)))
+(assert (= 9223372036854775808 (/ min -1)))
+(assert (= 1 (mod (+ max 2) 2)))
+
+                                        ; bitwise operations
+(assert (= min (bit-not max)))
+(assert (= -9223372036854775809 (bit-not (+ max 1))))
+(assert (= max (bit-and (+ max 1 max) max)))
+(assert (= -1 (bit-xor max min)))
+
+                                        ; the same value makes the same hash key
+(def h (hash))
+(hset! h (- (+ max 1) 1) "max")
+(hset! h 42 "small")
+(assert (= "max" (hget h max)))
+(assert (= "small" (hget h (- (* max 2) (- (* max 2) 42)))))
+(assert (= 2 (len h)))
+
+                                        ; printing and json
+(assert (= "9223372036854775808" (string (+ max 1))))
+(assert (= "-9223372036854775808" (string min)))
+(assert (= "[9223372036854775808,-1,0]" (json/stringify [(+ max 1) -1 0])))
+(assert (= (+ max 1) (int "9223372036854775808")))
+(assert (= 9223372036854775808.0 (float (+ max 1))))
+(assert (= 2 (int 2.4)))
@@ -37,3 +37,31 @@ func BenchmarkCallUserFunction(b *testing.B) {
 		env.Apply(fn, glisp.MakeArgs(glisp.NewSexpInt(i), glisp.NewSexpInt(i%10)))
 	}
 }
+
+func BenchmarkNumericLoop(b *testing.B) {
+	env := newFullEnv()
+	env.EvalString(`
+(defn sum-squares [i n acc]
+  (cond (> i n) acc
+        (let [sq (* i i)]
+          (sum-squares (+ i 1) n (+ acc sq)))))`)
+	obj, _ := env.FindObject("sum-squares")
+	fn := obj.(*glisp.SexpFunction)
+	for i := 0; i < b.N; i++ {
+		env.Apply(fn, glisp.MakeArgs(glisp.NewSexpInt(1), glisp.NewSexpInt(100), glisp.NewSexpInt(0)))
+	}
+}
+
+func BenchmarkCallGlobalFunction(b *testing.B) {
+	env := newFullEnv()
+	env.EvalString(`
+(defn square [x] (* x x))
+(defn sum-squares [i n acc]
+  (cond (> i n) acc
+        (sum-squares (+ i 1) n (+ acc (square i)))))`)
+	obj, _ := env.FindObject("sum-squares")
+	fn := obj.(*glisp.SexpFunction)
+	for i := 0; i < b.N; i++ {
+		env.Apply(fn, glisp.MakeArgs(glisp.NewSexpInt(1), glisp.NewSexpInt(100), glisp.NewSexpInt(0)))
+	}
+}
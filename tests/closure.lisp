@@ -59,9 +59,9 @@
 	(let [ v (s) ]
 		(cond
 			(empty? v) (assert (= (decending) ()))
-			((begin
+			(begin
 				(assert (= (decending) v))
-				(drainStore)))))
+				(drainStore))))
 	)
 		
 
@@ -0,0 +1,20 @@
+;; constants cannot be changed by def, set!, defn or defconst
+(defconst answer 42)
+(assert (= 42 answer))
+(def frozen "cannot change `answer`: binding is frozen")
+(assert (= frozen (try (def answer 1) (catch e (:message e)))))
+(assert (= frozen (try (set! answer 1) (catch e (:message e)))))
+(assert (= frozen (try (defconst answer 1) (catch e (:message e)))))
+(assert (= frozen (try ((fn [] (set! answer 1))) (catch e (:message e)))))
+(assert (= 42 answer))
+
+;; functions can be constants too
+(defconst twice (fn [x] (* 2 x)))
+(assert (= "cannot change `twice`: binding is frozen" (try (defn twice [x] x) (catch e (:message e)))))
+(assert (= 8 (twice 4)))
+
+;; locals may still shadow a constant
+(assert (= 1 (let [answer 1] answer)))
+(assert (= 3 ((fn [answer] (set! answer 3) answer) 2)))
+(assert (= 5 ((fn [] (def answer 5) answer))))
+(assert (= 42 answer))
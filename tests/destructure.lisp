@@ -0,0 +1,60 @@
+;; arrays and lists, with the rest and the whole value
+(let [[a b & more :as all] [1 2 3 4]]
+  (assert (= 1 a))
+  (assert (= 2 b))
+  (assert (= [3 4] more))
+  (assert (= [1 2 3 4] all)))
+(let [[a b & more] '(1 2 3)]
+  (assert (= '(3) more)))
+(let [[a b c] [1]]
+  (assert (= 1 a))
+  (assert (nil? b))
+  (assert (nil? c)))
+(let [[a & more] [1]]
+  (assert (nil? more)))
+
+;; hashes by key, with defaults
+(let [{:keys [name age] :or {age 18} :as person} {"name" "bob"}]
+  (assert (= "bob" name))
+  (assert (= 18 age))
+  (assert (= "bob" (:name person))))
+(let [{x :x y "y" z 'z} {"x" 1 "y" 2 'z 3}]
+  (assert (= 6 (+ x y z))))
+(let [{:keys [a]} {'a 1}]
+  (assert (= 1 a)))
+(let [{:keys [a] :or {a 2}} nil]
+  (assert (= 2 a)))
+
+;; nested patterns
+(def resp (json/parse "{\"user\":{\"name\":\"ann\",\"tags\":[\"a\",\"b\"]}}"))
+(let [{{name :name [first-tag] :tags} :user} resp]
+  (assert (= "ann" name))
+  (assert (= "a" first-tag)))
+
+;; let* sees the names bound before
+(let* [n 5
+       {:keys [m] :or {m n}} {}
+       [p] [m]]
+  (assert (= 5 p)))
+
+;; fn and defn parameters
+(defn area [{:keys [w h] :or {h 1}}] (* w h))
+(assert (= 6 (area {"w" 2 "h" 3})))
+(assert (= 2 (area {"w" 2})))
+(defn scale [k {:keys [w] :or {w k}} & [x y]] (list w x y))
+(assert (= '(2 3 4) (scale 1 {"w" 2} 3 4)))
+(assert (= '(1 () ()) (scale 1 {})))
+(assert (= 5 ((fn [[a [b c]]] (+ a b c)) [1 [2 2]])))
+(assert (= [3 7] (map (fn [[a b]] (+ a b)) [[1 2] [3 4]])))
+(defn dist
+  ([[x y]] (dist [0 0] [x y]))
+  ([[x1 y1] [x2 y2]] (+ (- x2 x1) (- y2 y1))))
+(assert (= 7 (dist [3 4])))
+
+;; caught errors
+(let [{:keys [message]} (try (throw "boom") (catch e e))]
+  (assert (= "boom" message)))
+
+;; errors
+(assert (= "cannot destructure int as a sequence" (try (let [[a] 1] a) (catch e (:message e)))))
+(assert (= "cannot destructure array as a hash" (try (let [{a :a} [1]] a) (catch e (:message e)))))
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -750,3 +751,28 @@ func TestWrongArgumentNumber(t *testing.T) {
 	ExpectScriptErr(t, `(time/parse "2014-Feb-04" "2006-Jan-02" 1)`, `time/parse with unsupported argument`)
 	ExpectScriptErr(t, `(time/parse "2014-Feb-04" "2006-Jan-02" "ak")`, `time/parse: unknown time zone`)
 }
+
+func TestErrorPosition(t *testing.T) {
+	ExpectScriptErr(t, "(def a 1)\n(defn f [x]\n  (+ x \"a\"))\n(f 1)", `3:3: operands have invalid type`)
+	ExpectScriptErr(t, "(let [x 1]\n  (json/parse \"{\"))", `2:3: Error calling json/parse`)
+	ExpectScriptErr(t, "(begin 1\n  (defn g [] (let [x] x)))", `2:14: Error generating (begin 1 (defn g [] (let [x] x)))`)
+	ExpectScriptErr(t, "(begin 1\n  (defn g [] (let [x] x)))", `Error generating (let [x] x): uneven let binding list`)
+	ExpectScriptErr(t, "(defconst k 1)\n(def k 2)\n3", "2:1: cannot change `k`: binding is frozen")
+	ExpectScriptErr(t, "(defconst k 1)\n(defconst k 2)\n3", "2:1: cannot change `k`: binding is frozen")
+
+	env := newFullEnv()
+	_, err := env.EvalString("(+ 1\n\n  (foo 2))")
+	var rtErr *glisp.RuntimeError
+	if !errors.As(err, &rtErr) || rtErr.Pos.Line != 3 || rtErr.Pos.Col != 3 {
+		t.Fatalf("should get runtime error at 3:3 but got %v", err)
+	}
+}
+
+func TestErrorPositionInFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bad.lisp")
+	if err := os.WriteFile(file, []byte("(def z 1)\n\n(defn bad [] (car 1))\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ExpectScriptErr(t, fmt.Sprintf("(include %q)\n(bad)", file), file+`:3:14:`)
+	ExpectScriptErr(t, fmt.Sprintf("(source-file %q)\n(bad)", file), file+`:3:14:`)
+}
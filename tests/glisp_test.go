@@ -2,11 +2,17 @@ package tests
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"math/big"
 	"net"
 	"os"
+	"slices"
 	"sort"
 
 	"github.com/qjpcpu/glisp"
@@ -15,7 +21,10 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 const testDir = `.`
@@ -787,6 +796,32 @@ func TestFloat64(t *testing.T) {
 	}
 }
 
+func TestSmallInt(t *testing.T) {
+	max := glisp.NewSexpInt64(math.MaxInt64)
+	one := glisp.NewSexpInt(1)
+	sum := max.Add(one)
+	if sum.IsInt64() || sum.SexpString() != "9223372036854775808" {
+		t.Fatal("bad overflow", sum.SexpString())
+	}
+	if back := sum.Sub(one); !back.IsInt64() || back.ToInt64() != math.MaxInt64 {
+		t.Fatal("bad shrink", back.SexpString())
+	}
+	bs, _ := sum.MarshalJSON()
+	if string(bs) != "9223372036854775808" {
+		t.Fatal("not equal", string(bs))
+	}
+	bs, _ = glisp.NewSexpInt(-42).MarshalJSON()
+	if string(bs) != "-42" {
+		t.Fatal("not equal", string(bs))
+	}
+	i := glisp.NewSexpInt(7)
+	if n := testing.AllocsPerRun(100, func() {
+		i = i.Add(one).Mul(one).Sub(one).Mod(glisp.NewSexpInt(1 << 20))
+	}); n != 0 {
+		t.Fatal("small integer arithmetic allocates", n)
+	}
+}
+
 func TestGoRecord(t *testing.T) {
 	vm := loadAllExtensions(glisp.New())
 	ret, err := vm.EvalString(`(defrecord GoR (Str string) (Int int) (Bool bool) (Bytes bytes "stream") (List list) (Array array) (Hash hash)) (->GoR Str "text")`)
@@ -1015,3 +1050,1119 @@ func TestMacroSymbolLostNotInREPL(t *testing.T) {
 `)
 	ExpectSuccess(t, err)
 }
+
+func TestRunContextDeadline(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := vm.EvalStringContext(ctx, `
+(defn forever [n] (forever (+ n 1)))
+(forever 0)
+`)
+	ExpectError(t, err, `evaluation cancelled`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("should be deadline exceeded but got %v", err)
+	}
+}
+
+func TestApplyContextCancelled(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	_, err := vm.EvalString(`(defn add [a b] (+ a b))`)
+	ExpectSuccess(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = vm.ApplyByNameContext(ctx, "add", glisp.MakeArgs(glisp.NewSexpInt(1), glisp.NewSexpInt(2)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("should be cancelled but got %v", err)
+	}
+}
+
+func TestChannelHonourContext(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := vm.EvalStringContext(ctx, `(<! (make-chan))`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("should be deadline exceeded but got %v", err)
+	}
+}
+
+func TestOSCmdHonourContext(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := vm.EvalStringContext(ctx, `(os/exec! "sleep 5")`)
+	ExpectError(t, err)
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("os/exec! should be killed once context is done")
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	vm.SetInstructionBudget(1000)
+	_, err := vm.EvalString(`
+(defn forever [n] (forever (+ n 1)))
+(forever 0)
+`)
+	var budgetErr *glisp.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("should get budget error but got %v", err)
+	}
+	if budgetErr.Limit != 1000 {
+		t.Fatalf("bad limit %v", budgetErr.Limit)
+	}
+	if used := vm.InstructionsUsed(); used < 1000 {
+		t.Fatalf("should use up budget but only used %v", used)
+	}
+}
+
+func TestInstructionsUsed(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	vm.SetOptimizer(false)
+	vm.SetInstructionBudget(0)
+	ret, err := vm.EvalString(`(+ 1 2)`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 3, ret)
+	if used := vm.InstructionsUsed(); used != 3 {
+		t.Fatalf("(+ 1 2) should use 3 instructions but got %v", used)
+	}
+}
+
+func TestInstructionBudgetSharedByCoroutine(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	vm.SetInstructionBudget(10000)
+	_, err := vm.EvalString(`
+(defn spin [n] (spin (+ n 1)))
+(go (spin 0))
+`)
+	ExpectSuccess(t, err)
+	deadline := time.Now().Add(2 * time.Second)
+	for vm.InstructionsUsed() <= 10000 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = vm.EvalString(`(+ 1 2)`)
+	var budgetErr *glisp.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("coroutine should use up the budget but got %v", err)
+	}
+}
+
+func TestAllocQuota(t *testing.T) {
+	quota := glisp.AllocQuota{MaxStringLen: 100, MaxArrayLen: 100, MaxHashLen: 10, MaxBytesLen: 10}
+	var quotaErr *glisp.QuotaExceededError
+	for _, script := range []string{
+		`(str/repeat "x" 1000000000)`,
+		`(bytes "0123456789a")`,
+		`(base64/decode "MDEyMzQ1Njc4OWE=")`,
+		`(os/read-file "test-data.json")`,
+		`(make-array 1000000000)`,
+		`(defn grow [a] (grow (append a 1))) (grow [])`,
+		`(concat (make-array 60) (make-array 60))`,
+		`(defn fill [h n] (hset! h n n) (fill h (+ n 1))) (fill {} 0)`,
+	} {
+		vm := loadAllExtensions(glisp.New())
+		vm.SetAllocQuota(quota)
+		_, err := vm.EvalString(script)
+		if !errors.As(err, &quotaErr) {
+			t.Fatalf("%s should exceed quota but got %v", script, err)
+		}
+	}
+	vm := loadAllExtensions(glisp.New())
+	vm.SetAllocQuota(quota)
+	ret, err := vm.EvalString(`(len (str/repeat "x" 100))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 100, ret)
+}
+
+func TestTryDoesNotCatchBudget(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	vm.SetInstructionBudget(1000)
+	_, err := vm.EvalString(`
+(defn spin [n] (spin (+ n 1)))
+(try (spin 0) (catch e "caught"))
+`)
+	var budgetErr *glisp.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("try should not catch budget error but got %v", err)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	deep := `(defn deep [n] (+ 1 (deep (+ n 1)))) (deep 0)`
+	for _, c := range []struct {
+		opt      glisp.EnvOption
+		script   string
+		stack    string
+		function string
+		limit    int
+	}{
+		{glisp.WithCallStack(8, 100), deep, "call", "deep", 100},
+		{glisp.WithStackStack(2, 50), deep, "stack", "deep", 50},
+		{glisp.WithDataStack(16, 64), deep, "data", "deep", 64},
+		{glisp.WithScopeStack(5), `(let [a 1] (let [b 2] (let [c 3] (let [d 4] (let [e 5] e)))))`, "scope", "__main", 5},
+	} {
+		vm := loadAllExtensions(glisp.NewWithOptions(c.opt))
+		_, err := vm.EvalString(c.script)
+		var overflow *glisp.StackOverflowError
+		if !errors.As(err, &overflow) {
+			t.Fatalf("%s should overflow but got %v", c.script, err)
+		}
+		if overflow.Stack != c.stack || overflow.Function != c.function || overflow.Limit != c.limit {
+			t.Fatalf("unexpected overflow %v", overflow)
+		}
+	}
+
+	vm := loadAllExtensions(glisp.NewWithOptions(glisp.WithCallStack(8, 100)))
+	ret, err := vm.EvalString(`(defn count [n] (cond (= n 10000) n (count (+ n 1)))) (count 0)`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 10000, ret)
+	ret, err = vm.EvalString(`(defn deep [n] (+ 1 (deep (+ n 1)))) (try (deep 0) (catch e (string e)))`)
+	ExpectSuccess(t, err)
+	if !strings.Contains(ret.SexpString(), "call stack overflow calling deep") {
+		t.Fatalf("try should catch stack overflow but got %v", ret.SexpString())
+	}
+}
+
+func TestCallCacheInvalidation(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	call := func(expect int64) {
+		t.Helper()
+		ret, err := vm.EvalString(`(call-twice)`)
+		ExpectSuccess(t, err)
+		ExpectEqInteger(t, expect, ret)
+	}
+	_, err := vm.EvalString(`(defn f [] 1) (defn call-twice [] (f) (f))`)
+	ExpectSuccess(t, err)
+	call(1)
+
+	_, err = vm.EvalString(`(defn f [] 2)`)
+	ExpectSuccess(t, err)
+	call(2)
+
+	_, err = vm.EvalString(`(set! f (fn [] 3))`)
+	ExpectSuccess(t, err)
+	call(3)
+
+	ExpectSuccess(t, vm.OverrideFunction("f", func(old *glisp.SexpFunction) glisp.UserFunction {
+		return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+			ret, err := env.Apply(old, args)
+			if err != nil {
+				return ret, err
+			}
+			return ret.(glisp.SexpInt).Add(glisp.NewSexpInt(1)), nil
+		}
+	}))
+	call(4)
+
+	vm.BindGlobal("f", glisp.MakeUserFunction("f", func(*glisp.Environment, glisp.Args) (glisp.Sexp, error) {
+		return glisp.NewSexpInt(5), nil
+	}))
+	call(5)
+
+	// local and dynamic bindings hide the cached global
+	ret, err := vm.EvalString(`
+(defn shadow [f] (f))
+(defn dynamic [] (let (array 'f (fn [] 7)) (f)))
+(+ (call-twice) (shadow (fn [] 6)) (dynamic) (call-twice))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 23, ret)
+
+	// closures over lets of different lists share their call instructions
+	ret, err = vm.EvalString(`
+(defn g [] "global")
+(defn mk [names] (let (names) (fn [] (g))))
+(def a (mk (fn [] (array 'g (fn [] "local")))))
+(def b (mk (fn [] (array 'x 1))))
+(list (b) (a) (b) (a))`)
+	ExpectSuccess(t, err)
+	ExpectEqString(t, `("global" "local" "global" "local")`, ret.SexpString())
+}
+
+func TestEnvPool(t *testing.T) {
+	template := loadAllExtensions(glisp.New())
+	_, err := template.EvalString(`(defn greet [n] (concat "hi " n)) (defn hello [] (greet "b")) (def counter 0)
+(def tick (let [n 0] (fn [] (set! n (+ n 1)) n)))`)
+	ExpectSuccess(t, err)
+	pool := glisp.NewEnvPool(template)
+
+	env := pool.Get()
+	ret, err := env.EvalString(`
+(def secret 1)
+(set! counter 5)
+(defn greet [n] "hacked")
+(defmac shout [] "!")
+(concat (greet "a") (hello) (shout) (string counter))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "hackedhacked!5", ret)
+	// an error leaves calls behind
+	_, err = env.EvalString(`(defn fail [] (+ 1 (undefined-function))) (fail)`)
+	ExpectError(t, err, "undefined-function")
+	pool.Put(env)
+
+	for i := 0; i < 2; i++ {
+		env = pool.Get()
+		ret, err = env.EvalString(`(concat (greet "a") (hello) (string counter))`)
+		ExpectSuccess(t, err)
+		ExpectEqStr(t, "hi ahi b0", ret)
+		for _, script := range []string{`secret`, `(shout)`} {
+			if _, err = env.EvalString(script); err == nil {
+				t.Fatalf("%s should not leak into another environment", script)
+			}
+		}
+		pool.Put(env)
+	}
+	if counter, _ := template.FindObject("counter"); counter.SexpString() != "0" {
+		t.Fatalf("template changed to %s", counter.SexpString())
+	}
+
+	// the variables captured by closures of the template are shared
+	for i := int64(1); i <= 2; i++ {
+		env = pool.Get()
+		ret, err = env.EvalString(`(tick)`)
+		ExpectSuccess(t, err)
+		ExpectEqInteger(t, i, ret)
+		pool.Put(env)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				env := pool.Get()
+				ret, err := env.EvalString(fmt.Sprintf(`(def id %d) (set! counter (+ counter id)) (greet (string counter))`, i))
+				if err == nil && ret.SexpString() != fmt.Sprintf(`"hi %d"`, i) {
+					err = fmt.Errorf("request %d got %s", i, ret.SexpString())
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				pool.Put(env)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestChildEnvironment(t *testing.T) {
+	parent := loadAllExtensions(glisp.New())
+	_, err := parent.EvalString(`
+(def counter 0)
+(defn bump [] (set! counter (+ counter 1)) counter)
+(def reset-counter (fn [] (set! counter 0)))
+(defmac shout [x] (concat x "!"))`)
+	ExpectSuccess(t, err)
+
+	child := parent.NewChild()
+	ret, err := child.EvalString(`(bump) (bump)`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 2, ret)
+	ret, err = child.EvalString(`(defmac shout [x] (concat x "?")) (def secret 1) (shout "hi")`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "hi?", ret)
+	// the closure would set! the global scope of the parent
+	_, err = child.EvalString(`(reset-counter)`)
+	if !errors.Is(err, glisp.ErrFrozen) {
+		t.Fatalf("should not change the parent but got %v", err)
+	}
+
+	sibling := parent.NewChild()
+	ret, err = sibling.EvalString(`(concat (shout "hi") (string counter))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "hi!0", ret)
+	if _, err = sibling.EvalString(`secret`); err == nil {
+		t.Fatal("bindings of a child should not leak into another")
+	}
+	ret, err = parent.EvalString(`counter`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 0, ret)
+	_, err = parent.EvalString(`(def counter 5)`)
+	ExpectError(t, err, "cannot change `counter`")
+
+	// children are made in constant time whatever the size of the parent
+	small, large := loadAllExtensions(glisp.New()), loadAllExtensions(glisp.New())
+	for i := 0; i < 1000; i++ {
+		ExpectSuccess(t, large.Bind(fmt.Sprintf("library-%d", i), glisp.NewSexpInt(i)))
+	}
+	smallAllocs := testing.AllocsPerRun(10, func() { small.NewChild() })
+	largeAllocs := testing.AllocsPerRun(10, func() { large.NewChild() })
+	if largeAllocs != smallAllocs {
+		t.Fatalf("child of a large parent made %v allocs, of a small one %v", largeAllocs, smallAllocs)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	env := loadAllExtensions(glisp.New())
+	_, err := env.EvalString(`(defmac shout [x] (concat x "!"))`)
+	ExpectSuccess(t, err)
+	ExpectSuccess(t, env.Freeze("map", "shout"))
+	ExpectError(t, env.Freeze("missing"), "`missing` not found")
+	for _, script := range []string{
+		`(def map 1)`,
+		`(set! map 1)`,
+		`(defn map [f xs] xs)`,
+		`(defmac shout [x] x)`,
+	} {
+		if _, err = env.EvalString(script); !errors.Is(err, glisp.ErrFrozen) {
+			t.Fatalf("%s should fail but got %v", script, err)
+		}
+	}
+	err = env.OverrideFunction("map", func(fn *glisp.SexpFunction) glisp.UserFunction {
+		return func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) { return glisp.SexpNull, nil }
+	})
+	if !errors.Is(err, glisp.ErrFrozen) {
+		t.Fatalf("override should fail but got %v", err)
+	}
+	ret, err := env.EvalString(`(concat (shout "hi") (string (map (fn [x] (+ x 1)) [1])))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "hi!2", ret)
+
+	// children cannot shadow frozen bindings of their parent
+	child := env.NewChild()
+	_, err = child.EvalString(`(defn map [f xs] xs)`)
+	ExpectError(t, err, "cannot change `map`")
+
+	env = loadAllExtensions(glisp.New())
+	ExpectSuccess(t, env.FreezeAll())
+	for _, script := range []string{`(def filter 1)`, `(set! json/parse 1)`} {
+		if _, err = env.EvalString(script); !errors.Is(err, glisp.ErrFrozen) {
+			t.Fatalf("%s should fail but got %v", script, err)
+		}
+	}
+	ret, err = env.EvalString(`(def mine 1) (def mine 2) mine`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 2, ret)
+}
+
+func TestHostValues(t *testing.T) {
+	type requestKey struct{}
+	env := loadAllExtensions(glisp.New())
+	env.SetValue("tenant", "acme")
+	env.AddFunction("host-info", func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+		tenant, _ := env.Value("tenant").(string)
+		request, _ := env.Value(requestKey{}).(string)
+		return glisp.SexpStr(tenant + "/" + request), nil
+	})
+	ctx := context.WithValue(context.Background(), requestKey{}, "req-1")
+
+	ret, err := env.EvalStringContext(ctx, `(host-info)`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "acme/req-1", ret)
+	// values reach macro expansion and coroutines
+	ret, err = env.EvalStringContext(ctx, `
+(defmac expanded-info [] (host-info))
+(def ch (make-chan 1))
+(go (send! ch (host-info)))
+(concat (expanded-info) " " (<! ch))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "acme/req-1 acme/req-1", ret)
+	ret, err = env.EvalString(`(host-info)`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "acme/", ret)
+
+	child := env.NewChild()
+	child.SetValue("tenant", "other")
+	ret, err = child.EvalString(`(host-info)`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "other/", ret)
+	if tenant := env.Value("tenant"); tenant != "acme" {
+		t.Fatalf("parent value changed to %v", tenant)
+	}
+}
+
+func TestAddGoFunc(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+		Age  int
+		Tags []string
+	}
+	funcs := map[string]any{
+		"greet": func(n int64, s string, opts map[string]any) (string, error) {
+			return fmt.Sprintf("%s%d%v", s, n, opts["mark"]), nil
+		},
+		"sum": func(base float64, nums ...int) float64 {
+			for _, n := range nums {
+				base += float64(n)
+			}
+			return base
+		},
+		"double":  func(i *big.Int) *big.Int { return new(big.Int).Lsh(i, 1) },
+		"small":   func(i int8) int8 { return i },
+		"upper":   func(b []byte) string { return strings.ToUpper(string(b)) },
+		"reverse": func(xs []string) []string { slices.Reverse(xs); return xs },
+		"birthday": func(u user) user {
+			u.Age++
+			u.Tags = append(u.Tags, "older")
+			return u
+		},
+		"year":     func(tm time.Time) int { return tm.Year() },
+		"new-year": func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) },
+		"check": func(n int) (int, error) {
+			if n < 0 {
+				return 0, errors.New("negative")
+			}
+			return n, nil
+		},
+		"tenant": func(ctx context.Context, env *glisp.Environment, suffix string) string {
+			return fmt.Sprint(ctx.Value("tenant"), env.Value("region"), suffix)
+		},
+		"describe": func(v any) string { return fmt.Sprintf("%T", v) },
+	}
+	newEnv := func() *glisp.Environment {
+		env := loadAllExtensions(glisp.New())
+		for name, fn := range funcs {
+			ExpectSuccess(t, env.AddGoFunc(name, fn))
+		}
+		env.SetValue("region", "eu")
+		return env
+	}
+	env := newEnv()
+
+	for script, expect := range map[string]string{
+		`(greet 7 "n" {"mark" "!"})`:                     `"n7!"`,
+		`(sum 0.5)`:                                      `0.5`,
+		`(sum 0.5 1 2)`:                                  `3.5`,
+		`(double 100000000000000000000)`:                 `200000000000000000000`,
+		`(upper "abc")`:                                  `"ABC"`,
+		`(upper (bytes "xyz"))`:                          `"XYZ"`,
+		`(reverse ["a" "b"])`:                            `["b" "a"]`,
+		`(reverse '("a" "b"))`:                           `["b" "a"]`,
+		`(:Age (birthday {"name" "bob" "age" 41}))`:      `42`,
+		`(:Tags (birthday {"name" "bob" "Tags" ["x"]}))`: `["x" "older"]`,
+		`(:name (birthday {"name" "bob"}))`:              `"bob"`,
+		`(year (new-year))`:                              `2024`,
+		`(time/year (new-year))`:                         `2024`,
+		`(check 3)`:                                      `3`,
+		`(describe 1)`:                                   `"int64"`,
+		`(describe [1 "a"])`:                             `"[]interface {}"`,
+	} {
+		ret, err := env.EvalString(script)
+		ExpectSuccess(t, err)
+		if ret.SexpString() != expect {
+			t.Fatalf("%s should be %s but got %s", script, expect, ret.SexpString())
+		}
+	}
+	ret, err := env.EvalStringContext(context.WithValue(context.Background(), "tenant", "acme"), `(tenant "/1")`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "acmeeu/1", ret)
+
+	for script, msg := range map[string]string{
+		`(greet 1)`:              "greet expect 3 argument(s) but got 1",
+		`(sum)`:                  "sum expect 1,... argument(s) but got 0",
+		`(greet "a" "b" {})`:     "greet 1st argument should be int64 but got string",
+		`(reverse ["a" 1])`:      "reverse 1st argument should be []string but got array",
+		`(small 1000)`:           "small 1st argument should be int8 but got int",
+		`(birthday {"Age" "x"})`: "birthday 1st argument should be tests.user but got hash",
+		`(check -1)`:             "negative",
+	} {
+		if _, err = newEnv().EvalString(script); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s should fail with %s but got %v", script, msg, err)
+		}
+	}
+	ExpectError(t, env.AddGoFunc("bad", 1), "bad should be function but got int")
+	ExpectError(t, env.AddGoFunc("bad", func(chan int) {}), "unsupported argument type chan int")
+	ExpectError(t, env.AddGoFunc("bad", func() (int, int) { return 0, 0 }), "at most a value and an error")
+}
+
+func TestMultiArity(t *testing.T) {
+	// tail calls within a body do not grow the call stack
+	env := loadAllExtensions(glisp.NewWithOptions(glisp.WithCallStack(8, 100)))
+	ret, err := env.EvalString(`
+(defn count-up
+  "counts up to 10000"
+  ([] (count-up 0))
+  ([n] (cond (= n 10000) n (count-up (+ n 1))))
+  ([n & more] (cond (= n 10000) (len more) (count-up (+ n 1) 1 2))))
+(+ (count-up) (count-up 0 1))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 10002, ret)
+	obj, _ := env.FindObject("count-up")
+	if doc := obj.(*glisp.SexpFunction).Doc(); doc != "counts up to 10000" {
+		t.Fatalf("unexpected doc %q", doc)
+	}
+
+	for script, msg := range map[string]string{
+		`(defn f ([a] a) ([b] b))`:              "f: more than one body taking 1 arguments",
+		`(defn f ([& a] a) ([b & c] b))`:        "f: more than one variadic body",
+		`(defn f ([a b c] a) ([b & c] b))`:      "f: body taking 3 arguments has more fixed arguments than the variadic body",
+		`(defn f ([a] a) (b b))`:                "f: function body must be a list starting with an argument vector",
+		`(defn f ([a] a) ([a b] a)) (f 1 2 3)`:  "f expected 1 or 2 arguments, got 3",
+		`((fn ([a] a) ([a b c & d] a)) 1 2)`:    "expected 1 or at least 3 arguments, got 2",
+		`((fn ([] 0) ([a] a) ([a b] a)) 1 2 3)`: "expected 0, 1 or 2 arguments, got 3",
+	} {
+		if _, err = loadAllExtensions(glisp.New()).EvalString(script); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s should fail with %s but got %v", script, msg, err)
+		}
+	}
+}
+
+func TestDestructure(t *testing.T) {
+	env := loadAllExtensions(glisp.New())
+	ret, err := env.EvalString(`
+(defrecord Point (x int) (y int))
+(defn norm1 [{:keys [x y]}] (+ x y))
+(let [{px :x [a b] :tags :or {a 0}} {"x" 1 "tags" [2]}]
+  (+ (norm1 (->Point x 3 y 4)) px a (cond (nil? b) 10 0)))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 20, ret)
+
+	// :or applies to the fields a record lacks, not to those set to nil
+	ret, err = env.EvalString(`
+(defrecord Person (name string) (age any))
+(let [{:keys [name age nope] :or {age 18 nope "none"}} (->Person name "tom")]
+  (list name age nope))`)
+	ExpectSuccess(t, err)
+	ExpectEqString(t, `("tom" () "none")`, ret.SexpString())
+
+	for script, msg := range map[string]string{
+		`(let [[a] "abc"] a)`: "cannot destructure string as a sequence",
+		`(defrecord Point (x int)) (let [{a 'a} (->Point x 1)] a)`: "cannot destructure Point by key a",
+		`(let [(a b) [1 2]] a)`:            "cannot bind to (a b)",
+		`(let [[a & b c] [1]] a)`:          "only :as may follow the rest of a pattern",
+		`(let [[a :as] [1]] a)`:            ":as must be followed by a symbol ending the pattern",
+		`(let [{a :a b} {}] a)`:            "uneven hash pattern",
+		`(let [{a [1]} {}] a)`:             "hash pattern key must be a string, :name or quoted symbol but got [1]",
+		`(let [{:keys [1]} {}] 1)`:         ":keys must be followed by an array of symbols but got int",
+		`(fn [a {:keys [b] :or [b 1]}] b)`: ":or must be followed by a hash of defaults",
+	} {
+		if _, err = loadAllExtensions(glisp.New()).EvalString(script); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s should fail with %s but got %v", script, msg, err)
+		}
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	// tail calls to other functions and through locals do not grow the
+	// call stack
+	env := loadAllExtensions(glisp.NewWithOptions(glisp.WithCallStack(8, 100)))
+	ret, err := env.EvalString(`
+(defn ping [n] (cond (= n 0) 0 (pong (- n 1))))
+(defn pong [n] (cond (= n 0) 1 (let [f ping] (f (- n 1)))))
+(defn spin [n] (cond (= n 0) n ((fn [m] (spin m)) (- n 1))))
+(+ (ping 100001) (spin 100000) (loop [i 0] (cond (= i 100000) i (recur (+ i 1)))))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 100001, ret)
+
+	// errors raised after tail calls are still caught
+	ret, err = env.EvalString(`(defn boom [n] (cond (= n 0) (throw "boom") (ping2 n)))
+(defn ping2 [n] (boom (- n 1)))
+(try (boom 10000) (catch e (:message e)))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "boom", ret)
+
+	for script, msg := range map[string]string{
+		`(recur 1)`:                              "recur outside of loop or function",
+		`(loop [i 0] (+ 1 (recur i)))`:           "recur must be in tail position",
+		`(loop [i 0] (recur))`:                   "recur expected 1 arguments, got 0",
+		`(defn f [a & b] (recur 1))`:             "recur expected 2 arguments, got 1",
+		`(loop [i 0] (try (recur 1) (catch e)))`: "recur must be in tail position",
+		`(loop [i] i)`:                           "uneven loop binding list",
+		`(loop i i)`:                             "loop bindings must be in array",
+	} {
+		if _, err = loadAllExtensions(glisp.New()).EvalString(script); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s should fail with %s but got %v", script, msg, err)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	modules := func() glisp.FileReader {
+		return OnceFileReader(map[string]string{
+			"lib.lisp": `(ns lib)
+(defn- hidden [] 1)
+(defn pub [] (hidden))
+(defmac twice [x] ` + "`" + `(+ ~x ~x))`,
+			"plain.lisp": `(defn f [] 1)`,
+			"count.lisp": `(ns count) (set! runs (+ runs 1))`,
+		})
+	}
+
+	// the reader hands out each file once, the second require is cached
+	env := loadAllExtensions(glisp.New())
+	env.SetFileReader(modules())
+	ret, err := env.EvalString(`(require "lib.lisp" :as l) (require "lib.lisp" :as l2) (+ (l/pub) (l2/pub) (l/twice 1))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 4, ret)
+
+	// a module runs once, when the first of its requires does
+	env = loadAllExtensions(glisp.New())
+	env.SetFileReader(modules())
+	ret, err = env.EvalString(`
+(def runs 0)
+(cond false (require "lib.lisp" :as m) 1)
+(require "lib.lisp" :as m)
+(require "count.lisp")
+(require "count.lisp")
+(list (m/pub) runs)`)
+	ExpectSuccess(t, err)
+	ExpectEqString(t, `(1 1)`, ret.SexpString())
+	ret, err = env.EvalString(`(require "count.lisp") runs`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 1, ret)
+
+	// children see the namespaces of their parent, their own definitions
+	// stay in the child
+	parent := loadAllExtensions(glisp.New())
+	parent.SetFileReader(modules())
+	_, err = parent.EvalString(`(ns app) (require "lib.lisp" :as l) (defn one [] (l/pub))`)
+	ExpectSuccess(t, err)
+	child := parent.NewChild()
+	ret, err = child.EvalString(`(defn two [] (+ (one) (l/pub))) (ns lib) (defn more [] 3) (+ (app/two) (more))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 5, ret)
+	for _, script := range []string{`(two)`, `(lib/more)`} {
+		if _, err = parent.NewChild().EvalString(script); err == nil {
+			t.Fatalf("%s should not leak into another child", script)
+		}
+	}
+
+	// ns stays current across evaluations, other namespaces see its names
+	// qualified and so do the environments cloned from it
+	_, err = env.EvalString(`(ns app) (defn pub [] "app") (defmac twice [x] x)`)
+	ExpectSuccess(t, err)
+	ret, err = env.Clone().EvalString(`(list (pub) (twice 3) (lib/twice 3))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, `("app" 3 6)`, glisp.SexpStr(ret.SexpString()))
+	ret, err = env.EvalString(`(ns other) (app/pub)`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "app", ret)
+	_, err = env.EvalString(`(pub)`)
+	ExpectError(t, err, "pub")
+
+	for script, msg := range map[string]string{
+		`(require "lib.lisp" :as l) (l/hidden)`: "hidden is private to namespace lib",
+		`(require "lib.lisp") lib/hidden`:       "hidden is private to namespace lib",
+		`(require "lib.lisp") (#'lib/hidden)`:   "hidden is private to namespace lib",
+		`(require "plain.lisp" :as p)`:          "require: plain.lisp does not declare a namespace",
+		`(require "lib.lisp" :alias l)`:         "require expects a path and an optional :as alias",
+		`(defn f [] (ns inner))`:                "ns must be at the top level",
+		`(ns a/b)`:                              "namespace name a/b must not contain /",
+	} {
+		env := loadAllExtensions(glisp.New())
+		env.SetFileReader(modules())
+		if _, err = env.EvalString(script); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s should fail with %s but got %v", script, msg, err)
+		}
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	lib := fstest.MapFS{
+		"util/main.lisp":   {Data: []byte(`(include "helper.lisp") (defn main [] (helper))`)},
+		"util/helper.lisp": {Data: []byte(`(defn helper [] "next to main")`)},
+		"helper.lisp":      {Data: []byte(`(defn helper [] "root")`)},
+		"geo.lisp":         {Data: []byte(`(ns geo) (defn area [r] (* 3 r r))`)},
+	}
+	dir := t.TempDir()
+	ExpectSuccess(t, os.WriteFile(filepath.Join(dir, "extra.lisp"), []byte(`(def extra 1)`), 0644))
+
+	env := loadAllExtensions(glisp.New())
+	env.SetSearchPath(glisp.FSFileReader("lib", lib), glisp.DirFileReader(dir))
+	ret, err := env.EvalString(`(include "util/main.lisp" "extra.lisp")
+(require "geo.lisp" :as g)
+(source-file "geo.lisp")
+(list (main) (g/area 2) extra)`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, `("next to main" 12 1)`, glisp.SexpStr(ret.SexpString()))
+	ExpectEqAny(t, []glisp.Module{
+		{Name: "util/main.lisp", Path: "lib:util/main.lisp"},
+		{Name: "helper.lisp", Path: "lib:util/helper.lisp"},
+		{Name: "extra.lisp", Path: filepath.Join(dir, "extra.lisp")},
+		{Name: "geo.lisp", Path: "lib:geo.lisp"},
+	}, env.Modules())
+
+	_, err = env.EvalString(`(include "nope.lisp")`)
+	ExpectError(t, err, "cannot find nope.lisp, tried nope.lisp, lib:nope.lisp, "+filepath.Join(dir, "nope.lisp"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("%v should be a missing file error", err)
+	}
+	// files loaded again are listed once
+	_, err = env.EvalString(`(include "util/main.lisp")`)
+	ExpectSuccess(t, err)
+	ExpectEqAny(t, 4, len(env.Modules()))
+
+	// a directory reader does not leave its directory
+	outside := t.TempDir()
+	ExpectSuccess(t, os.WriteFile(filepath.Join(outside, "secret.lisp"), []byte(`(def secret 1)`), 0644))
+	escape, err := filepath.Rel(dir, filepath.Join(outside, "secret.lisp"))
+	ExpectSuccess(t, err)
+	for _, file := range []string{escape, filepath.Join("sub", "..", escape)} {
+		if _, err = glisp.DirFileReader(dir).Open(file); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s should not be found but got %v", file, err)
+		}
+	}
+	env = loadAllExtensions(glisp.New())
+	env.SetFileReader(glisp.DirFileReader(dir))
+	_, err = env.EvalString(`(include "extra.lisp") (include "` + filepath.ToSlash(escape) + `")`)
+	ExpectError(t, err, "cannot find")
+}
+
+func TestConcurrentSymbols(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	var wg sync.WaitGroup
+	syms := make([][]glisp.SexpSymbol, 16)
+	gensyms := make([][]glisp.SexpSymbol, len(syms))
+	for i := range syms {
+		env := vm.Duplicate()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				syms[i] = append(syms[i], env.MakeSymbol(fmt.Sprintf("sym-%d", j)))
+				gensyms[i] = append(gensyms[i], env.GenSymbol())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i := range syms {
+		for j, sym := range syms[i] {
+			if expect := vm.MakeSymbol(sym.Name()); sym.Number() != expect.Number() {
+				t.Fatalf("%s numbered %d and %d", sym.Name(), sym.Number(), expect.Number())
+			}
+			gen := gensyms[i][j]
+			if seen[gen.Number()] || vm.MakeSymbol(gen.Name()).Number() != gen.Number() {
+				t.Fatalf("gensym %s is not unique", gen.Name())
+			}
+			seen[gen.Number()] = true
+		}
+	}
+}
+
+func TestConcurrentCoroutines(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	ret, err := vm.EvalString(`
+(defrecord Point (X int) (Y int))
+(def ch (make-chan 64))
+(defn worker [id]
+  (send! ch (realize (map (fn [i]
+                            (let [name (concat "sym-" (string id) "-" (string i))
+                                  p (eval (list '->Point 'X id 'Y i))]
+                              [name (symbol name) (gensym) (:Y p) i]))
+                          (range 20)))))
+(def n 32)
+(realize (map (fn [id] (eval (list 'go (list 'worker id)))) (range n)))
+(def seen {})
+(def ok true)
+(realize (map (fn [_]
+                (map (fn [item]
+                       (set! ok (and ok
+                                     (= (aget item 1) (symbol (aget item 0)))
+                                     (= (aget item 3) (aget item 4))))
+                       (hset! seen (aget item 2) true))
+                     (<! ch)))
+              (range n)))
+(and ok (= (len seen) (* n 20)))`)
+	ExpectSuccess(t, err)
+	if ret != glisp.SexpBool(true) {
+		t.Fatal("coroutines disagree on symbols")
+	}
+}
+
+func TestUncaughtThrow(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	_, err := vm.EvalString(`(throw {"code" 500})`)
+	var throwErr *glisp.ThrowError
+	if !errors.As(err, &throwErr) {
+		t.Fatalf("should get ThrowError but got %v", err)
+	}
+	code, err := throwErr.Value.(*glisp.SexpHash).HashGet(glisp.SexpStr("code"))
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 500, code)
+}
+
+func TestRuntimeErrorStack(t *testing.T) {
+	var vm *glisp.Environment
+	expectStack := func(script string, names []string, nargs []int) *glisp.RuntimeError {
+		vm = loadAllExtensions(glisp.New())
+		vm.AddFunction("go-fail", func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+			return glisp.SexpNull, errors.New("go failure")
+		})
+		vm.AddMacro("go-mac", func(env *glisp.Environment, args glisp.Args) (glisp.Sexp, error) {
+			return glisp.SexpNull, errors.New("macro failure")
+		})
+		_, err := vm.EvalString(script)
+		var rtErr *glisp.RuntimeError
+		if !errors.As(err, &rtErr) {
+			t.Fatalf("%s should get runtime error but got %v", script, err)
+		}
+		if len(rtErr.Stack) < len(names) {
+			t.Fatalf("%s should get %d frames but got %v", script, len(names), rtErr.Stack)
+		}
+		for i, name := range names {
+			if frame := rtErr.Stack[i]; (name != "" && frame.Function != name) || frame.Nargs != nargs[i] {
+				t.Fatalf("%s frame %d should be %s/%d but got %v/%d", script, i, name, nargs[i], frame, frame.Nargs)
+			}
+		}
+		return rtErr
+	}
+
+	rtErr := expectStack("(defn inner [a b] (car a))\n(defn outer [x] (+ 1 (inner x 2)))\n(outer 1)",
+		[]string{"inner", "outer", "__main"}, []int{2, 1, 0})
+	if pos := rtErr.Stack[1].Pos; pos.Line != 2 || pos.Col != 22 {
+		t.Fatalf("outer frame should be at 2:22 but got %v", pos)
+	}
+	if trace := vm.GetStackTrace(rtErr); trace != vm.GetStackTrace(rtErr) || !strings.Contains(trace, "in outer:") {
+		t.Fatalf("bad stack trace %s", trace)
+	}
+
+	rtErr = expectStack("(defn call-it [] (+ 1 (go-fail 1 2 3)))\n(call-it)",
+		[]string{"go-fail", "call-it"}, []int{3, 0})
+	if frame := rtErr.Stack[0]; frame.PC != -1 || frame.Pos.IsValid() {
+		t.Fatalf("Go function frame should have no pc but got %v", frame)
+	}
+
+	expectStack("(map (fn [x] (go-fail x)) [1])", []string{"go-fail", "", "map", "__main"}, []int{1, 1, 2, 0})
+
+	expectStack("(defmac bad-mac [x] (car x))\n(bad-mac 2)", []string{"bad-mac"}, []int{1})
+
+	expectStack("(go-mac 1 2)", []string{"go-mac"}, []int{2})
+}
+
+func TestDebugger(t *testing.T) {
+	script := `(defn add [a b]
+  (+ a b))
+(defn twice [x]
+  (def y (add x x))
+  (* y 2))
+(twice 3)`
+	type stop struct {
+		fn     string
+		pos    string
+		locals string
+	}
+	run := func(setup func(*glisp.Debugger), actions ...glisp.DebugAction) ([]stop, glisp.Sexp, error) {
+		var stops []stop
+		dbg := glisp.NewDebugger(func(p *glisp.Pause) glisp.DebugAction {
+			var locals []string
+			for _, b := range p.Env.LocalBindings() {
+				locals = append(locals, b.Name+"="+b.Value.SexpString())
+			}
+			stops = append(stops, stop{fn: p.Function, pos: p.Pos.String(), locals: strings.Join(locals, ",")})
+			if len(stops) > len(actions) {
+				return glisp.DebugContinue
+			}
+			return actions[len(stops)-1]
+		})
+		setup(dbg)
+		vm := loadAllExtensions(glisp.New())
+		vm.AttachDebugger(dbg)
+		ret, err := vm.EvalString(script)
+		return stops, ret, err
+	}
+	expectStops := func(got []stop, want ...stop) {
+		if len(got) != len(want) {
+			t.Fatalf("should stop %d times but got %v", len(want), got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("stop %d should be %v but got %v", i, want[i], got[i])
+			}
+		}
+	}
+
+	stops, ret, err := run(func(d *glisp.Debugger) { d.BreakOnFunction("twice") },
+		glisp.DebugStepOver, glisp.DebugStepOver)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 12, ret)
+	expectStops(stops,
+		stop{"twice", "4:10", "x=3"},
+		stop{"twice", "4:3", "x=3"},
+		stop{"twice", "5:3", "x=3,y=6"})
+
+	stops, _, err = run(func(d *glisp.Debugger) { d.BreakOnFunction("twice") },
+		glisp.DebugStepInto, glisp.DebugStepOut)
+	ExpectSuccess(t, err)
+	expectStops(stops,
+		stop{"twice", "4:10", "x=3"},
+		stop{"add", "2:3", "a=3,b=3"},
+		stop{"twice", "4:3", "x=3"})
+
+	stops, _, err = run(func(d *glisp.Debugger) { d.BreakOnLine("", 5) })
+	ExpectSuccess(t, err)
+	expectStops(stops, stop{"twice", "5:3", "x=3,y=6"})
+
+	_, _, err = run(func(d *glisp.Debugger) { d.BreakOnLine("", 2) }, glisp.DebugAbort)
+	if !errors.Is(err, glisp.ErrDebugAbort) {
+		t.Fatalf("should abort but got %v", err)
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	p := glisp.NewProfiler()
+	vm.AttachProfiler(p)
+	_, err := vm.EvalString(`(defn fib [n] (cond (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(defn boom [] (throw "boom"))
+(try (map (fn [x] (boom)) [1 2]) (catch e 1))
+(map fib [5 10])`)
+	ExpectSuccess(t, err)
+
+	calls := make(map[string]glisp.FuncProfile)
+	for _, fp := range p.Functions() {
+		calls[fp.Name] = fp
+	}
+	if calls["fib"].Calls != 192 || calls["map"].Calls != 2 || calls["boom"].Calls != 1 {
+		t.Fatalf("bad call counts %+v", calls)
+	}
+	if fib := calls["fib"]; fib.Self <= 0 || fib.Self != fib.Cum {
+		t.Fatalf("bad fib times %+v", fib)
+	}
+	if m := calls["map"]; m.Cum < calls["fib"].Cum {
+		t.Fatalf("map should include fib %+v", m)
+	}
+
+	var buf bytes.Buffer
+	ExpectSuccess(t, p.WriteProfile(&buf))
+	zr, err := gzip.NewReader(&buf)
+	ExpectSuccess(t, err)
+	data, err := io.ReadAll(zr)
+	ExpectSuccess(t, err)
+	for _, name := range []string{"fib", "boom", "calls", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(name)) {
+			t.Fatalf("profile misses %s", name)
+		}
+	}
+}
+
+func TestCompiledScripts(t *testing.T) {
+	// coroutines and records are values which cannot be compiled
+	skip := map[string]bool{"coroutines.lisp": true, "record.lisp": true, "stream.lisp": true}
+	for _, script := range listScripts(t) {
+		if skip[filepath.Base(script)] {
+			continue
+		}
+		compiler := loadAllExtensions(glisp.New())
+		exprs, err := compiler.ParseFile(script)
+		ExpectSuccess(t, err)
+		var buf bytes.Buffer
+		if err = compiler.CompileToWriter(&buf, exprs); err != nil {
+			t.Errorf("compile %s: %v", script, err)
+			continue
+		}
+
+		vm := loadAllExtensions(glisp.New())
+		if err = vm.LoadCompiled(&buf); err != nil {
+			t.Errorf("load %s: %v", script, err)
+			continue
+		}
+		if _, err = vm.Run(); err != nil {
+			t.Errorf("run %s: %v", script, err)
+		}
+	}
+}
+
+func TestCompiledVersion(t *testing.T) {
+	vm := newFullEnv()
+	exprs, err := vm.ParseStream(strings.NewReader(`(defn f [x] (:a x)) (f {'a 42})`))
+	ExpectSuccess(t, err)
+	var buf bytes.Buffer
+	ExpectSuccess(t, vm.CompileToWriter(&buf, exprs))
+	data := buf.Bytes()
+
+	vm = newFullEnv()
+	ExpectSuccess(t, vm.LoadCompiled(bytes.NewReader(data)))
+	ret, err := vm.Run()
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 42, ret)
+
+	// the Go functions embedded by macros are found without being globals
+	ret, err = vm.EvalString(`(list (defined? '__doc) (defined? '__defined?) (defined? '__explain))`)
+	ExpectSuccess(t, err)
+	ExpectEqStr(t, "(false false false)", glisp.SexpStr(ret.SexpString()))
+
+	ExpectError(t, newFullEnv().LoadCompiled(bytes.NewReader(data[:len(data)/2])), "bad bytecode")
+	ExpectError(t, newFullEnv().LoadCompiled(strings.NewReader("(+ 1 2)")), "not glisp bytecode")
+
+	// the version follows the 8 byte magic
+	data[8]++
+	err = newFullEnv().LoadCompiled(bytes.NewReader(data))
+	if !errors.Is(err, glisp.ErrBytecodeVersion) {
+		t.Fatalf("expect version error but got %v", err)
+	}
+}
+
+func TestOptimizer(t *testing.T) {
+	scripts := map[string]string{
+		"fold":       `(+ 1 (* 2 3) (- 10 4))`,
+		"compare":    `(cond (< 1 2 3) 1 (= 1 1) 2 3)`,
+		"div":        `(begin (def x (/ 10 4)) (str x))`,
+		"no fold":    `(try (/ 1 0) (catch e "caught"))`,
+		"and/or":     `(or (and 1 nil) (and 2 3))`,
+		"nested":     `(defn f [n] (cond (< n 0) (cond (= n -1) "a" "b") (> n 10) "c" "d")) (str (f -1) (f -2) (f 11) (f 5))`,
+		"scopes":     `(let [a 1] (let [] (let [b 2] (+ a b 0.5))))`,
+		"tail":       `(defn loop [n acc] (cond (= n 0) acc (loop (- n 1) (+ acc 1)))) (loop 100 0)`,
+		"quote":      `(begin 1 2 (quote x) (str (quote (+ 1 2))))`,
+		"try":        `(try (begin 1 (throw "x")) (catch e (:message e)) (finally 3))`,
+		"big":        `(* 99999999999 99999999999 99999999999)`,
+		"float cmp":  `(list (< 1 1.5) (+ 0.1 0.2) (= 3 3.0))`,
+		"empty expr": `(begin (let [] 1) nil 2)`,
+	}
+	for name, script := range scripts {
+		plain := loadAllExtensions(glisp.New())
+		plain.SetOptimizer(false)
+		expect, err1 := plain.EvalString(script)
+
+		vm := loadAllExtensions(glisp.New())
+		vm.SetInstructionBudget(0)
+		ret, err2 := vm.EvalString(script)
+		if (err1 == nil) != (err2 == nil) {
+			t.Fatalf("%s: errors differ %v %v", name, err1, err2)
+		}
+		if err1 == nil && expect.SexpString() != ret.SexpString() {
+			t.Fatalf("%s: expect %s but got %s", name, expect.SexpString(), ret.SexpString())
+		}
+	}
+
+	vm := loadAllExtensions(glisp.New())
+	vm.SetInstructionBudget(0)
+	ret, err := vm.EvalString(`(+ 1 (* 2 3))`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 7, ret)
+	if used := vm.InstructionsUsed(); used != 1 {
+		t.Fatalf("constants should be folded but used %v instructions", used)
+	}
+}
+
+func TestLexicalAddressing(t *testing.T) {
+	vm := loadAllExtensions(glisp.New())
+	_, err := vm.EvalString(`(defn f [a] (let [b 2] (+ a b g)))`)
+	ExpectSuccess(t, err)
+	var buf bytes.Buffer
+	ExpectSuccess(t, vm.DumpFunctionByName(&buf, "f"))
+	for _, instr := range []string{"get a 1:0", "get b 0:0", "get g\n"} {
+		if !strings.Contains(buf.String(), instr) {
+			t.Fatalf("expect %q in\n%s", instr, buf.String())
+		}
+	}
+
+	_, err = vm.EvalString(`(def g 3)`)
+	ExpectSuccess(t, err)
+	ret, err := vm.EvalString(`(f 1)`)
+	ExpectSuccess(t, err)
+	ExpectEqInteger(t, 6, ret)
+
+	// the debugger sees local variables by name
+	var locals []glisp.Binding
+	d := glisp.NewDebugger(func(p *glisp.Pause) glisp.DebugAction {
+		locals = p.Env.LocalBindings()
+		return glisp.DebugContinue
+	})
+	d.BreakOnFunction("g2")
+	vm.AttachDebugger(d)
+	_, err = vm.EvalString(`(defn g2 [x] (+ x 1)) (defn h [y] (let [z 1] (g2 (+ y z)))) (h 1)`)
+	ExpectSuccess(t, err)
+	if len(locals) != 1 || locals[0].Name != "x" || locals[0].Value.SexpString() != "2" {
+		t.Fatalf("unexpected locals %v", locals)
+	}
+}
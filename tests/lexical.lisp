@@ -0,0 +1,77 @@
+;; closures share the variables they capture, set! is seen by both sides
+(def counter nil)
+(let [n 0]
+  (set! counter (fn [] (set! n (+ n 1)) n))
+  (counter)
+  (counter)
+  (assert (= n 2)))
+(assert (= (counter) 3))
+
+;; every call of a tail recursive function binds new variables
+(defn collect [i acc]
+  (cond (= i 0) acc
+    (collect (- i 1) (cons (fn [] i) acc))))
+(assert (= (map (fn [f] (f)) (collect 3 '())) '(1 2 3)))
+
+;; rebinding after a closure was created does not change the closure
+(let* [a 1
+       f (fn [] a)
+       a 2]
+  (assert (= a 2))
+  (assert (= (f) 1)))
+
+;; let values see the outer bindings of the names they bind
+(let [x 1]
+  (let [x (+ x 1) y x]
+    (assert (= x 2))
+    (assert (= y 1))))
+
+;; def binds in the innermost scope and shadows parameters
+(defn shadow [x]
+  (let [y 1]
+    (def x (+ x y))
+    x))
+(assert (= (shadow 5) 6))
+
+;; until the def runs the name refers to the global binding
+(def g-val "global")
+(defn late [c]
+  (cond c (def g-val "local") nil)
+  g-val)
+(assert (= (late false) "global"))
+(assert (= (late true) "local"))
+(assert (= g-val "global"))
+
+;; set! reaches through nested scopes
+(defn outer-set [v]
+  (let [a 1]
+    (let [b 2]
+      (set! v (+ a b))))
+  v)
+(assert (= (outer-set 0) 3))
+
+;; nested closures
+(defn adder [a]
+  (fn [b] (fn [c] (+ a b c))))
+(assert (= (((adder 1) 2) 3) 6))
+
+;; bindings known only at run time shadow the lexical ones
+(let [k 1]
+  (let (array 'k 2)
+    (assert (= k 2)))
+  (assert (= k 1)))
+
+;; the error of catch is a local
+(defn caught [e]
+  (try (throw "boom") (catch e (:message e))))
+(assert (= (caught 1) "boom"))
+
+;; calls look functions up by name, parameters included
+(defn call-it [f x] (f x))
+(assert (= (call-it (fn [v] (* v 2)) 7) 14))
+
+;; a let captured by a closure leaves no scope behind
+(let* [f (fn [] 1) v 2] v)
+(def after-let 1)
+(defn read-after-let [] after-let)
+(assert (= (read-after-let) 1))
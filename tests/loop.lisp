@@ -0,0 +1,38 @@
+;; loop and recur
+(assert (= 45 (loop [i 0 acc 0] (cond (= i 10) acc (recur (+ i 1) (+ acc i))))))
+(assert (= [0 1 4] (loop [i 0 out []]
+  (cond (= i 3) out
+        (let [x (* i i)] (recur (+ i 1) (append out x)))))))
+(assert (= '(3 2 1) (loop [[x & xs] [1 2 3] acc '()]
+  (cond (nil? x) acc (recur xs (cons x acc))))))
+(assert (= 3 (loop [i 0] (loop [j i] (cond (< j 3) (recur (+ j 1)) j)))))
+
+;; a loop not in tail position
+(defn plus-one [n] (+ 1 (loop [i n] (cond (= i 0) 0 (recur (- i 1))))))
+(assert (= 1 (plus-one 10)))
+
+;; recur starts the function over, the rest is passed as a list
+(defn sum [acc & xs] (cond (nil? xs) acc (recur (+ acc (car xs)) (cdr xs))))
+(assert (= 10 (sum 0 1 2 3 4)))
+
+;; tail calls between functions and through locals
+(defn even2? [n] (cond (= n 0) true (odd2? (- n 1))))
+(defn odd2? [n] (cond (= n 0) false (even2? (- n 1))))
+(assert (even2? 10000))
+(defn walk [n] (let [step (fn [m] (walk m))] (cond (= n 0) "done" (step (- n 1)))))
+(assert (= "done" (walk 10000)))
+
+;; calls in other positions still return
+(defn ident [n] n)
+(defn wrap [n] [(ident n)])
+(assert (= [3] (wrap 3)))
+(defn add-one [n] (let [x (ident n)] (+ x 1)))
+(assert (= 4 (add-one 3)))
+(assert (= [2 3] ((fn [x] (map (fn [y] (+ x y)) [1 2])) 1)))
+
+;; the function called in tail position is not itself a tail call
+(defn thunk [] (fn [] "called"))
+(defn call-thunk [] ((begin (thunk))))
+(assert (= "called" (call-thunk)))
+(defn again [n] (cond (= n 0) (fn [] "again") ((begin (again (- n 1))))))
+(assert (= "again" (again 1)))
@@ -0,0 +1,31 @@
+;; a body per number of arguments
+(defn greet
+  "greets someone"
+  ([] (greet "world"))
+  ([name] (greet "hello" name))
+  ([greeting name] (concat greeting " " name))
+  ([greeting name & more] (concat (greet greeting name) " and " (string (len more)) " more")))
+(assert (= "hello world" (greet)))
+(assert (= "hello bob" (greet "bob")))
+(assert (= "hi bob" (greet "hi" "bob")))
+(assert (= "hi bob and 2 more" (greet "hi" "bob" "ann" "joe")))
+
+;; tail calls within a body, calls of other bodies
+(defn count-down
+  ([n] (count-down n 0))
+  ([n acc] (cond (= n 0) acc (count-down (- n 1) (+ acc 1)))))
+(assert (= 1000 (count-down 1000)))
+
+;; closures and higher order functions
+(def adder (let [base 10]
+  (fn ([] base)
+      ([x] (+ base x))
+      ([x & xs] (+ base x (len xs))))))
+(assert (= 10 (adder)))
+(assert (= 11 (adder 1)))
+(assert (= 13 (adder 1 2 3)))
+(defn pick ([a] a) ([a b] b))
+(assert (= [1 2] (map pick [1 2])))
+(assert (= 2 (apply pick [1 2])))
+(assert (= "pick expected 1 or 2 arguments, got 0" (try (pick) (catch e (:message e)))))
+(assert (= "pick expected 1 or 2 arguments, got 3" (try (pick 1 2 3) (catch e (:message e)))))
@@ -0,0 +1,22 @@
+(require "./ns-util.lisp" :as u)
+
+(assert (= 12 (u/quad 3)))
+(assert (= 42 (u/reveal)))
+(assert (= "HI" (u/shout "hi")))
+(assert (u/even-steps? 10))
+(assert (= 10 (u/doubled 5)))
+
+;; the full name of the namespace works without the alias
+(assert (= 8 (util/quad 2)))
+
+;; names of the module do not clash with the global ones
+(defn quad [x] "mine")
+(assert (= "mine" (quad 1)))
+(assert (= 4 (u/quad 1)))
+(assert (= 4 (#'u/quad 1)))
+(assert (= [4 8] (map u/quad [1 2])))
+
+;; a module is loaded once
+(hset! u/state "seen" true)
+(require "./ns-util.lisp" :as util2)
+(assert (= true (hget util2/state "seen")))
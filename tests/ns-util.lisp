@@ -0,0 +1,16 @@
+;; a module required by namespaces.lisp
+(ns util)
+
+(def state (hash))
+(def- secret 42)
+(defn- twice [x] (* 2 x))
+(defn quad [x] (twice (twice x)))
+(defn reveal [] secret)
+(defn shout [s] (str/upper s))
+
+;; functions may call the ones defined after them
+(defn even-steps? [n] (cond (= n 0) true (odd-steps? (- n 1))))
+(defn odd-steps? [n] (cond (= n 0) false (even-steps? (- n 1))))
+
+;; expansions may use the private names of the macro's namespace
+(defmac doubled [x] `(twice ~x))
@@ -0,0 +1,55 @@
+;; catch errors raised by builtins
+(assert (= "caught" (try (car 1) (catch e "caught"))))
+(assert (error? (try (json/parse "{") (catch e e))))
+(assert (= 3 (try (+ 1 2) (catch e 0))))
+
+;; throw arbitrary data
+(assert (= 404 (try (throw {"code" 404}) (catch e (:code (:data e))))))
+(assert (= "boom" (try (throw "boom") (catch e (:message e)))))
+(assert (nil? (try (car 1) (catch e (:data e)))))
+
+;; errors raised deep in the call stack and inside higher order functions
+(defn fail-at [n] (cond (= n 0) (throw "bottom") (+ 1 (fail-at (- n 1)))))
+(assert (= "bottom" (try (fail-at 10) (catch e (:message e)))))
+(assert (= "bad 2"
+           (try (map (fn [x] (cond (= x 2) (throw (str/join ["bad" (string x)] " ")) x)) [1 2 3])
+                (catch e (:data e)))))
+
+;; stacks are unwound, locals bound before the error are gone
+(def outer 1)
+(assert (= 1 (try (let [outer 2] (car outer)) (catch e outer))))
+(assert (= [1 2 3] [1 (try (let [x 5] (throw x)) (catch e 2)) 3]))
+
+;; finally runs on success and on error
+(def log [])
+(assert (= 1 (try 1 (finally (set! log (append log "ok"))))))
+(assert (= 2 (try (throw 1) (catch e 2) (finally (set! log (append log "err"))))))
+(assert (= ["ok" "err"] log))
+
+;; finally rethrows an uncaught error, nested try catches it
+(def cleaned false)
+(assert (= "inner"
+           (try
+             (try (throw "inner") (finally (set! cleaned true)))
+             (catch e (:data e)))))
+(assert cleaned)
+
+;; errors inside catch propagate through finally
+(def cleaned2 false)
+(assert (= "from catch"
+           (try
+             (try (throw 1) (catch e (throw "from catch")) (finally (set! cleaned2 true)))
+             (catch e (:message e)))))
+(assert cleaned2)
+
+;; rethrow a caught error
+(assert (= 42 (try (try (throw 42) (catch e (throw e))) (catch e (:data e)))))
+
+;; try in a loop keeps working
+(defn count-errors [n acc]
+  (cond (= n 0) acc
+        (count-errors (- n 1) (+ acc (try (throw n) (catch e 1))))))
+(assert (= 100 (count-errors 100 0)))
+
+;; try inside a callback of a builtin
+(assert (= [1 2 3] (map (fn [x] (try (throw x) (catch e (:data e)))) [1 2 3])))
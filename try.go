@@ -0,0 +1,133 @@
+package glisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ThrowError is the error raised by (throw x), Value holds the thrown data.
+type ThrowError struct {
+	Value Sexp
+}
+
+func (e *ThrowError) Error() string {
+	if str, ok := e.Value.(SexpStr); ok {
+		return string(str)
+	}
+	return e.Value.SexpString()
+}
+
+// throwValue turns the argument of throw into an error, throwing a caught
+// error value raises the original error again.
+func throwValue(expr Sexp) error {
+	if e, ok := expr.(SexpError); ok {
+		return e.Err
+	}
+	return &ThrowError{Value: expr}
+}
+
+// tryHandler is installed by OpTry, it records the stack tops to unwind to
+// when an error is raised before the matching OpEndTry.
+type tryHandler struct {
+	function   *SexpFunction
+	catchpc    int
+	datatop    int
+	addrtop    int
+	stacktop   int
+	scopestack *ScopeStack
+	scopetop   *ScopeLayer
+	depth      int
+}
+
+func (env *Environment) pushHandler(catchpc int) {
+	env.handlers = append(env.handlers, tryHandler{
+		function:   env.curfunc,
+		catchpc:    catchpc,
+		datatop:    env.datastack.Top(),
+		addrtop:    env.addrstack.Top(),
+		stacktop:   env.stackstack.Top(),
+		scopestack: env.scopestack,
+		scopetop:   env.scopestack.top,
+		depth:      env.depth,
+	})
+}
+
+func (env *Environment) popHandler() error {
+	if len(env.handlers) == 0 {
+		return errors.New("endtry without try")
+	}
+	env.handlers = env.handlers[:len(env.handlers)-1]
+	return nil
+}
+
+// dropHandlers removes the handlers installed by runs at depth or deeper.
+func (env *Environment) dropHandlers(depth int) {
+	n := len(env.handlers)
+	for n > 0 && env.handlers[n-1].depth >= depth {
+		n--
+	}
+	env.handlers = env.handlers[:n]
+}
+
+// isFatal reports errors that try must not catch, so scripts cannot escape
+// a cancelled context or an exhausted instruction budget.
+func isFatal(err error) bool {
+	var budgetErr *BudgetExceededError
+	return errors.As(err, &budgetErr) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// catch unwinds the stacks to the innermost handler installed by the
+// current run and pushes the error value for the catch clause. It returns
+// false if no such handler exists.
+func (env *Environment) catch(err error) bool {
+	if isFatal(err) {
+		return false
+	}
+	env.dropHandlers(env.depth + 1)
+	n := len(env.handlers)
+	if n == 0 || env.handlers[n-1].depth != env.depth {
+		return false
+	}
+	h := env.handlers[n-1]
+	env.handlers = env.handlers[:n-1]
+
+	env.datastack.DropExpr(env.datastack.Top() - h.datatop)
+	env.addrstack.tos = h.addrtop
+	if env.profiler != nil {
+		env.profiler.leave(h.addrtop)
+	}
+	for env.stackstack.Top() > h.stacktop {
+		scopestack, _ := env.stackstack.Pop()
+		env.scopestack.Clear()
+		env.scopestack = scopestack
+	}
+	for env.scopestack.top != h.scopetop && env.scopestack.top != nil {
+		env.scopestack.Pop()
+	}
+	env.curfunc = h.function
+	env.pc = h.catchpc
+	env.datastack.PushExpr(NewErrorWith(err))
+	return true
+}
+
+// Explain implements the colon accessors of a caught error, (:message e)
+// returns the error message and (:data e) the value passed to throw.
+func (s SexpError) Explain(env *Environment, field string, args Args) (Sexp, error) {
+	if args.Len() > 0 {
+		return WrongNumberArguments("error field accessor", args.Len(), 0)
+	}
+	switch field {
+	case "message":
+		return SexpStr(s.Err.Error()), nil
+	case "data":
+		var throwErr *ThrowError
+		if errors.As(s.Err, &throwErr) {
+			return throwErr.Value, nil
+		}
+		return SexpNull, nil
+	}
+	return SexpNull, fmt.Errorf("field %s not found", field)
+}
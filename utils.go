@@ -24,6 +24,26 @@ func WrongNumberArguments(funcname string, current int, expect ...int) (Sexp, er
 	return SexpNull, fmt.Errorf(`%s expect %s argument(s) but got %v`, funcname, strings.Join(exp, ","), current)
 }
 
+// WrongArgumentType reports the argument at position n, counted from 1, of
+// funcname not being of the expected type.
+func WrongArgumentType(funcname string, n int, expect string, got Sexp) (Sexp, error) {
+	return SexpNull, fmt.Errorf(`%s %s argument should be %s but got %v`, funcname, ordinal(n), expect, InspectType(got))
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
 func WrongGeneratorNumberArguments(funcname string, current int, expect ...int) error {
 	_, err := WrongNumberArguments(funcname, current, expect...)
 	return err